@@ -0,0 +1,279 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCP states, as found in /proc/net/tcp
+const (
+	tcpStateEstablished = "01"
+	tcpStateListen      = "0A"
+)
+
+// ConnectionDrainOptions controls when the application is
+// considered to have no connection left to drain
+type ConnectionDrainOptions struct {
+	// Ports are the local ports whose connections are counted.
+	// Empty means the ports the main process listens on, or
+	// the backend health check port if none is found.
+	Ports []int
+	// Threshold is the number of established connections
+	// at or below which the drain is complete
+	Threshold int
+}
+
+type tcpSocket struct {
+	local     string
+	remote    string
+	localPort int
+	state     string
+	inode     string
+}
+
+// readTCPSockets parses the IPv4 and IPv6 sockets of /proc/net
+func readTCPSockets() ([]tcpSocket, error) {
+	var sockets []tcpSocket
+
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) && path == "/proc/net/tcp6" {
+			// IPv6 is disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+
+			_, portHex, _ := strings.Cut(fields[1], ":")
+			port, err := strconv.ParseInt(portHex, 16, 32)
+			if err != nil {
+				continue
+			}
+
+			sockets = append(sockets, tcpSocket{
+				local:     fields[1],
+				remote:    fields[2],
+				localPort: int(port),
+				state:     fields[3],
+				inode:     fields[9],
+			})
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	return sockets, nil
+}
+
+// socketInodes returns the inodes of the sockets opened by
+// process pid, which may be "self"
+func socketInodes(pid string) (map[string]bool, error) {
+	dir := filepath.Join("/proc", pid, "fd")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[string]bool)
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			// closed in the meantime
+			continue
+		}
+
+		if inode, ok := strings.CutPrefix(target, "socket:["); ok {
+			inodes[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+
+	return inodes, nil
+}
+
+// listeningPorts returns the ports process pid listens on
+func listeningPorts(pid int) ([]int, error) {
+	inodes, err := socketInodes(strconv.Itoa(pid))
+	if err != nil {
+		return nil, err
+	}
+
+	sockets, err := readTCPSockets()
+	if err != nil {
+		return nil, err
+	}
+
+	var ports []int
+	for _, s := range sockets {
+		if s.state == tcpStateListen && inodes[s.inode] {
+			ports = append(ports, s.localPort)
+		}
+	}
+
+	return ports, nil
+}
+
+// establishedConnections counts the established connections to
+// the local ports, leaving out the ones opened by delth itself
+// such as health checks
+func establishedConnections(ports []int) (int, error) {
+	sockets, err := readTCPSockets()
+	if err != nil {
+		return 0, err
+	}
+
+	own, err := socketInodes("self")
+	if err != nil {
+		return 0, err
+	}
+
+	ownEndpoints := make(map[string]bool)
+	for _, s := range sockets {
+		if own[s.inode] {
+			ownEndpoints[s.local] = true
+		}
+	}
+
+	count := 0
+	for _, s := range sockets {
+		if s.state != tcpStateEstablished || ownEndpoints[s.remote] {
+			continue
+		}
+
+		for _, port := range ports {
+			if s.localPort == port {
+				count++
+				break
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// connectionTracker watches the established connections
+// to the application
+type connectionTracker struct {
+	opts ConnectionDrainOptions
+	log  *slog.Logger
+}
+
+func newConnectionTracker(opts ConnectionDrainOptions) *connectionTracker {
+	return &connectionTracker{
+		opts: opts,
+		log:  slog.Default().With("component", "connection-tracker"),
+	}
+}
+
+// ports returns the ports to watch, using the ones main process
+// pid listens on or fallback when none is configured
+func (t *connectionTracker) ports(pid int, fallback int) []int {
+	if len(t.opts.Ports) > 0 {
+		return t.opts.Ports
+	}
+
+	if pid > 0 {
+		ports, err := listeningPorts(pid)
+		if err != nil {
+			t.log.Warn("getting main process listening ports", "pid", pid, "error", err)
+		} else if len(ports) > 0 {
+			return ports
+		}
+	}
+
+	return []int{fallback}
+}
+
+// Drained returns a channel that is closed once the established
+// connections to ports are at or below the threshold
+func (t *connectionTracker) Drained(ctx context.Context, ports []int) <-chan struct{} {
+	drained := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+
+		last := -1
+		for {
+			count, err := establishedConnections(ports)
+			if err != nil {
+				// the drain goes on until its maximum duration
+				t.log.Error("counting established connections", "error", err)
+				return
+			}
+
+			if count <= t.opts.Threshold {
+				t.log.Info("established connections are drained", "connections", count, "ports", ports)
+				close(drained)
+				return
+			}
+
+			if count != last {
+				t.log.Info("waiting for established connections to be closed", "connections", count, "threshold", t.opts.Threshold, "ports", ports)
+				last = count
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return drained
+}
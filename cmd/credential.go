@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// cmdCredential is the identity a command runs with
+type cmdCredential struct {
+	uid      uint32
+	gid      uint32
+	groups   []uint32
+	username string
+	home     string
+}
+
+func parseID(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(id), true
+}
+
+func lookupGroupID(spec string) (uint32, error) {
+	if gid, ok := parseID(spec); ok {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	gid, ok := parseID(g.Gid)
+	if !ok {
+		return 0, fmt.Errorf("invalid gid %q for group %q", g.Gid, spec)
+	}
+
+	return gid, nil
+}
+
+// resolveCredential resolves user and group names or numeric IDs using
+// /etc/passwd and /etc/group. When supplementary groups are not given,
+// the ones the user is a member of are used. A numeric uid missing from
+// /etc/passwd gets the same gid unless a group is given. It returns nil
+// when neither a user nor a group is requested.
+func resolveCredential(userSpec, groupSpec string, supplementaryGroups []string) (*cmdCredential, error) {
+	if userSpec == "" && groupSpec == "" && len(supplementaryGroups) == 0 {
+		return nil, nil
+	}
+
+	cred := &cmdCredential{
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+		groups: []uint32{},
+	}
+
+	var u *user.User
+	if userSpec != "" {
+		var err error
+		if uid, ok := parseID(userSpec); ok {
+			// numeric IDs do not need to exist in /etc/passwd
+			cred.uid = uid
+			if u, err = user.LookupId(userSpec); err != nil {
+				u = nil
+			}
+		} else if u, err = user.Lookup(userSpec); err != nil {
+			return nil, err
+		}
+
+		if u != nil {
+			uid, ok := parseID(u.Uid)
+			if !ok {
+				return nil, fmt.Errorf("invalid uid %q for user %q", u.Uid, userSpec)
+			}
+			gid, ok := parseID(u.Gid)
+			if !ok {
+				return nil, fmt.Errorf("invalid gid %q for user %q", u.Gid, userSpec)
+			}
+			cred.uid, cred.gid = uid, gid
+			cred.username, cred.home = u.Username, u.HomeDir
+		} else {
+			// never inherit delth group, which is root's when
+			// delth runs as root, nor its user name
+			cred.gid = cred.uid
+			cred.username = strconv.FormatUint(uint64(cred.uid), 10)
+			cred.home = "/"
+		}
+	}
+
+	if groupSpec != "" {
+		gid, err := lookupGroupID(groupSpec)
+		if err != nil {
+			return nil, err
+		}
+		cred.gid = gid
+	}
+
+	if len(supplementaryGroups) > 0 {
+		for _, spec := range supplementaryGroups {
+			gid, err := lookupGroupID(spec)
+			if err != nil {
+				return nil, err
+			}
+			cred.groups = append(cred.groups, gid)
+		}
+	} else if u != nil {
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("looking up groups of user %q: %w", u.Username, err)
+		}
+		for _, g := range gids {
+			if gid, ok := parseID(g); ok {
+				cred.groups = append(cred.groups, gid)
+			}
+		}
+	}
+
+	return cred, nil
+}
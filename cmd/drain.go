@@ -0,0 +1,111 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Drain modes, deciding when the shutdown delay ends before
+// its maximum duration
+const (
+	// DrainModeDelay waits for the whole shutdown delay
+	DrainModeDelay = "delay"
+	// DrainModeProbes waits for load balancers to notice delth
+	// is draining, see ProbeDrainOptions
+	DrainModeProbes = "probes"
+	// DrainModeConnections waits for the connections to the
+	// application to be closed, see ConnectionDrainOptions
+	DrainModeConnections = "connections"
+)
+
+// drainPollInterval is the delay between two evaluations
+// of a drain completion condition
+const drainPollInterval = 250 * time.Millisecond
+
+// drainer waits for the main process to be drained before it
+// is stopped, according to the 'cmd-exec.drain' settings
+type drainer struct {
+	cfg          drainConfig
+	probes       *probeTracker
+	fallbackPort int
+	failureDelay time.Duration
+	failed       func() bool
+	supervisor   *supervisor
+	force        context.Context
+	log          *slog.Logger
+}
+
+// Wait waits at most delay for the drain to complete and returns why
+// the wait has ended. Once delth has failed, there is nothing to drain
+// and the failure delay is waited for instead.
+func (d *drainer) Wait(delay time.Duration) string {
+	drainCtx, drainCancel := context.WithCancel(context.Background())
+	defer drainCancel()
+
+	mainDone := d.supervisor.Main().Done()
+
+	var drained <-chan struct{}
+	if d.failed() {
+		// the proxy already reports delth as unhealthy, there
+		// is nothing to drain from a failed process
+		delay = d.failureDelay
+		mainDone = nil
+	} else if d.probes != nil {
+		drained = d.probes.Drained(drainCtx, time.Now())
+	} else if d.cfg.Mode == DrainModeConnections {
+		conns := newConnectionTracker(ConnectionDrainOptions{
+			Ports:     d.cfg.ConnectionsPorts,
+			Threshold: d.cfg.ConnectionsThreshold,
+		})
+		ports := conns.ports(d.supervisor.Main().Pid(), d.fallbackPort)
+		drained = conns.Drained(drainCtx, ports)
+	}
+
+	d.log.Debug("delaying process shutdown", "delay", delay)
+
+	delayTimer := time.NewTimer(delay)
+	defer delayTimer.Stop()
+
+	select {
+	case <-delayTimer.C:
+		return "shutdown delay expired"
+	case <-d.force.Done():
+		return "shutdown delay skipped"
+	case <-mainDone:
+		return "main process has exited"
+	case <-drained:
+		return "drain is complete"
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+type drainNotifyConfig struct {
+	// Signal is sent to the main process
+	Signal string `mapstructure:"signal"`
+	// HTTP is a request performed to the application
+	HTTP hookHTTPConfig `mapstructure:"http"`
+	// File is a marker file created when the drain starts
+	File    string        `mapstructure:"file"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// drainNotifier tells the application that delth is draining,
+// so that it can close idle connections and refuse new work
+type drainNotifier struct {
+	cfg     drainNotifyConfig
+	sig     syscall.Signal
+	hClient httpDoer
+	log     *slog.Logger
+}
+
+func newDrainNotifier(cfg drainNotifyConfig) (*drainNotifier, error) {
+	n := &drainNotifier{
+		cfg:     cfg,
+		hClient: http.DefaultClient,
+		log:     slog.Default().With("component", "drain-notifier"),
+	}
+
+	if cfg.Signal != "" {
+		sig, err := parseSignal(cfg.Signal)
+		if err != nil {
+			return nil, fmt.Errorf("parsing drain notification signal: %w", err)
+		}
+		n.sig = sig
+	}
+
+	if cfg.HTTP.Path != "" && cfg.HTTP.Port == 0 {
+		return nil, errors.New("missing drain notification HTTP port")
+	}
+
+	return n, nil
+}
+
+// Reset removes any marker file left over by a previous run
+func (n *drainNotifier) Reset() error {
+	if n.cfg.File == "" {
+		return nil
+	}
+
+	if err := os.Remove(n.cfg.File); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Notify notifies the application running as e by every
+// configured means. Failures are only logged.
+func (n *drainNotifier) Notify(ctx context.Context, e *executor) {
+	if n.sig != 0 {
+		n.log.Info("notifying application of the drain", "signal", n.sig.String())
+		if err := e.Signal(n.sig); err != nil {
+			n.log.Warn("sending drain notification signal", "error", err)
+		}
+	}
+
+	if n.cfg.File != "" {
+		n.log.Info("notifying application of the drain", "file", n.cfg.File)
+		if err := os.WriteFile(n.cfg.File, []byte(time.Now().Format(time.RFC3339)+"\n"), 0o644); err != nil {
+			n.log.Warn("creating drain notification file", "error", err)
+		}
+	}
+
+	if n.cfg.HTTP.Port != 0 {
+		n.log.Info("notifying application of the drain", "http-port", n.cfg.HTTP.Port, "http-path", n.cfg.HTTP.Path)
+
+		if n.cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeout)
+			defer cancel()
+		}
+
+		if err := doHookHTTP(ctx, n.hClient, n.log, n.cfg.HTTP); err != nil {
+			n.log.Warn("performing drain notification HTTP request", "error", err)
+		}
+	}
+}
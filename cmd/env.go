@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/subosito/gotenv"
+)
+
+// fileSecretSuffix is the suffix of variables pointing to a file whose
+// content must be used as the value of the variable without the suffix,
+// as in the Docker secrets FOO_FILE=/run/secrets/foo convention
+const fileSecretSuffix = "_FILE"
+
+// setEnv sets key to value in env, replacing any existing definition
+func setEnv(env []string, key, value string) []string {
+	return append(unsetEnv(env, key), key+"="+value)
+}
+
+// unsetEnv removes key from env
+func unsetEnv(env []string, key string) []string {
+	prefix := key + "="
+	out := make([]string, 0, len(env))
+
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			out = append(out, kv)
+		}
+	}
+
+	return out
+}
+
+func lookupEnv(env []string, key string) (string, bool) {
+	prefix := key + "="
+
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return kv[len(prefix):], true
+		}
+	}
+
+	return "", false
+}
+
+// stripDelthEnv removes delth configuration variables from env
+func stripDelthEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "DELTH_") {
+			out = append(out, kv)
+		}
+	}
+
+	return out
+}
+
+// loadEnvFiles loads dotenv files into env, in order
+func loadEnvFiles(env []string, files []string) ([]string, error) {
+	for _, file := range files {
+		vars, err := gotenv.Read(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading env file %q: %w", file, err)
+		}
+
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			env = setEnv(env, k, vars[k])
+		}
+	}
+
+	return env, nil
+}
+
+// expandFileSecrets replaces every FOO_FILE=/path variable of env
+// with FOO=<content of /path>. Only files within secretsDir are
+// considered, so that variables like SSL_CERT_FILE are left untouched.
+func expandFileSecrets(env []string, secretsDir string) ([]string, error) {
+	out := env
+	secretsDir = filepath.Clean(secretsDir) + string(filepath.Separator)
+
+	for _, kv := range env {
+		key, path, _ := strings.Cut(kv, "=")
+		if !strings.HasSuffix(key, fileSecretSuffix) || key == fileSecretSuffix {
+			continue
+		}
+
+		if !strings.HasPrefix(filepath.Clean(path), secretsDir) {
+			continue
+		}
+
+		target := strings.TrimSuffix(key, fileSecretSuffix)
+		if _, exists := lookupEnv(env, target); exists {
+			return nil, fmt.Errorf("both %s and %s are set", target, key)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading secret file of %s: %w", key, err)
+		}
+
+		out = unsetEnv(out, key)
+		out = setEnv(out, target, strings.TrimRight(string(content), "\r\n"))
+	}
+
+	return out, nil
+}
+
+// buildCmdEnv computes the environment of the wrapped commands
+func buildCmdEnv(cfg config) ([]string, error) {
+	env := os.Environ()
+
+	if cfg.CommandExec.StripDelthEnv {
+		env = stripDelthEnv(env)
+	}
+
+	env, err := loadEnvFiles(env, cfg.CommandExec.EnvFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CommandExec.ExpandFileSecrets {
+		if env, err = expandFileSecrets(env, cfg.CommandExec.FileSecretsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.CommandExec.InjectMetadata {
+		env = setEnv(env, "DELTH_META_HEALTHCHECK_LISTEN_ADDR", cfg.HealthCheckProxy.ListenAddr)
+		env = setEnv(env, "DELTH_META_BACKEND_HEALTHCHECK_PORT", fmt.Sprint(cfg.BackendHealthCheck.Port))
+		env = setEnv(env, "DELTH_META_BACKEND_HEALTHCHECK_PATH", cfg.BackendHealthCheck.Path)
+		env = setEnv(env, "DELTH_META_SHUTDOWN_DELAY_SECONDS", fmt.Sprint(cfg.CommandExec.ShutdownDelay.Seconds()))
+		env = setEnv(env, "DELTH_META_STOP_TIMEOUT_SECONDS", fmt.Sprint(cfg.CommandExec.StopTimeout.Seconds()))
+		env = setEnv(env, "DELTH_META_PID", fmt.Sprint(os.Getpid()))
+	}
+
+	return env, nil
+}
@@ -33,88 +33,596 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// errCmdKilled is returned by Stop() when the underlying process
+// did not exit before the stop timeout and had to be killed
+var errCmdKilled = errors.New("command killed after stop timeout")
+
+// errExecutorStopping is returned when a command restart is
+// attempted while the executor is being stopped
+var errExecutorStopping = errors.New("executor is stopping")
+
+const processGroupPollInterval = 100 * time.Millisecond
+
+// outputWaitDelay bounds the time spent waiting for captured output
+// pipes to be closed once the underlying process has exited, as
+// they may be kept open by its own children
+const outputWaitDelay = 2 * time.Second
+
 type executor struct {
-	cmd            *exec.Cmd
-	log            *slog.Logger
-	ctx            context.Context
-	cmdWaitErr     chan error
-	onCmdFailureCb func(*exec.ExitError)
+	name       string
+	args       []string
+	opts       CmdExecutorOptions
+	log        *slog.Logger
+	ctx        context.Context
+	cmdWaitErr chan error
+	done       chan struct{}
+
+	mu       sync.Mutex
+	cbs      executorCallbacks
+	cmd      *exec.Cmd
+	outputs  []*lineLogger
+	pty      *ptySession
+	running  bool
+	stopping bool
+	stopC    chan struct{}
+}
+
+type executorCallbacks struct {
+	onCmdEnd   func(error)
+	onCmdStart func()
+	onCmdExit  func(error)
+}
+
+type CmdExecutorOptions struct {
+	// Name identifies the command in logs
+	Name string
+	// StopSignal is sent to the underlying process by Stop()
+	StopSignal syscall.Signal
+	// StopTimeout is the delay after which the underlying process
+	// is sent a SIGKILL if it has not exited yet. Zero means wait forever.
+	StopTimeout time.Duration
+	// SignalProcessGroup delivers stop signals to the whole process group
+	// of the underlying process and waits for all of its members to exit
+	SignalProcessGroup bool
+	// Restart controls if and how the underlying process is restarted
+	// when it exits on its own
+	Restart RestartOptions
+	// Credential is the identity the underlying process runs with.
+	// Nil means the one of delth.
+	Credential *cmdCredential
+	// Env is the environment of the underlying process.
+	// Nil means the one of delth.
+	Env []string
+	// CaptureOutput re-emits every line of the underlying process
+	// output as a log record instead of passing delth file descriptors
+	CaptureOutput bool
+	// JSONLines controls how captured lines that are JSON objects
+	// are handled, see JSONLinesMerge and others
+	JSONLines string
+	// LogFile, when set, receives a copy of the underlying
+	// process output. It is not closed by the executor.
+	LogFile io.Writer
+	// TTY allocates a pseudo-terminal as the controlling terminal
+	// of the underlying process. Its output is merged into stdout.
+	TTY bool
+	// ListenFiles are listening sockets handed over to the underlying
+	// process following the systemd LISTEN_FDS protocol
+	ListenFiles []*os.File
 }
 
-func NewCmdExecutor(ctx context.Context, name string, args ...string) *executor {
+func NewCmdExecutor(ctx context.Context, opts CmdExecutorOptions, name string, args ...string) *executor {
+	if opts.StopSignal == 0 {
+		opts.StopSignal = syscall.SIGTERM
+	}
+
+	log := slog.Default().With("component", "executor")
+	if opts.Name != "" {
+		log = log.With("process", opts.Name)
+	}
+
 	e := &executor{
-		cmd:        exec.Command(name, args...),
-		log:        slog.Default().With("component", "executor"),
+		name:       name,
+		args:       args,
+		opts:       opts,
+		log:        log,
 		ctx:        ctx,
 		cmdWaitErr: make(chan error, 1),
+		done:       make(chan struct{}),
+		stopC:      make(chan struct{}),
+	}
+
+	return e
+}
+
+// SetOnCmdEndCb registers a callback invoked when the command has
+// exited on its own, successfully or not, and will not be restarted
+func (e *executor) SetOnCmdEndCb(cb func(error)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cbs.onCmdEnd = cb
+}
+
+// SetOnCmdStartCb registers a callback invoked every time
+// the command is (re)started
+func (e *executor) SetOnCmdStartCb(cb func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cbs.onCmdStart = cb
+}
+
+// SetOnCmdExitCb registers a callback invoked every time
+// the command exits without having been asked to
+func (e *executor) SetOnCmdExitCb(cb func(error)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cbs.onCmdExit = cb
+}
+
+func (e *executor) callbacks() executorCallbacks {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.cbs
+}
+
+// newGeneration returns a new executor running the same command
+// with the same options, the variables of env added to its
+// environment, without any callback registered
+func (e *executor) newGeneration(env []string) *executor {
+	opts := e.opts
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		opts.Env = setEnv(opts.Env, key, value)
 	}
-	e.cmd.Stdin = os.Stdin
-	e.cmd.Stderr = os.Stderr
-	e.cmd.Stdout = os.Stdout
-	e.cmd.SysProcAttr = &syscall.SysProcAttr{
+
+	return NewCmdExecutor(e.ctx, opts, e.name, e.args...)
+}
+
+// adoptCallbacks registers the callbacks of from on e, as e takes
+// over the supervision of the command
+func (e *executor) adoptCallbacks(from *executor) {
+	cbs := from.callbacks()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cbs = cbs
+}
+
+func (e *executor) newCmd() (*exec.Cmd, []*lineLogger) {
+	var outputs []*lineLogger
+
+	cmd := exec.Command(e.name, e.args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	if e.opts.CaptureOutput {
+		log := slog.Default().With("component", "cmd-output", "process", e.opts.Name)
+		outputs = captureOutput(log, cmd, e.opts.JSONLines)
+		cmd.WaitDelay = outputWaitDelay
+	}
+
+	if e.opts.LogFile != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, e.opts.LogFile)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, e.opts.LogFile)
+		cmd.WaitDelay = outputWaitDelay
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setsid: true, // stop signal propagation
 	}
 
-	return e
+	cmd.Env = e.opts.Env
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+
+	if cred := e.opts.Credential; cred != nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    cred.uid,
+			Gid:    cred.gid,
+			Groups: cred.groups,
+		}
+
+		if cred.home != "" {
+			cmd.Env = setEnv(cmd.Env, "HOME", cred.home)
+		}
+		if cred.username != "" {
+			cmd.Env = setEnv(cmd.Env, "USER", cred.username)
+			cmd.Env = setEnv(cmd.Env, "LOGNAME", cred.username)
+		}
+	}
+
+	if len(e.opts.ListenFiles) > 0 {
+		listenFDsCmd(cmd, e.opts.ListenFiles)
+	}
+
+	return cmd, outputs
 }
 
-func (e *executor) SetOnCmdFailureCb(cb func(*exec.ExitError)) {
-	e.onCmdFailureCb = cb
+func (e *executor) startCmd() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stopping || e.ctx.Err() != nil {
+		return errExecutorStopping
+	}
+
+	cmd, outputs := e.newCmd()
+
+	var pty *ptySession
+	if e.opts.TTY {
+		p, err := attachPTY(cmd)
+		if err != nil {
+			return fmt.Errorf("allocating PTY: %w", err)
+		}
+		pty = p
+	}
+
+	if err := procReaper.Start(cmd); err != nil {
+		if pty != nil {
+			pty.Close()
+		}
+		return err
+	}
+
+	if pty != nil {
+		pty.started()
+	}
+
+	e.cmd = cmd
+	e.outputs = outputs
+	e.pty = pty
+	e.running = true
+
+	e.log.Debug("command successfully started", "pid", cmd.Process.Pid)
+
+	return nil
 }
 
 func (e *executor) Start() error {
-	if err := e.cmd.Start(); err != nil {
+	if err := e.startCmd(); err != nil {
 		return err
 	}
 
-	e.log.Debug("command successfully started")
+	if cb := e.callbacks().onCmdStart; cb != nil {
+		cb()
+	}
+
+	go e.supervise()
+
+	return nil
+}
+
+// supervise waits for the underlying process and restarts it
+// according to the restart policy until the executor is stopped
+func (e *executor) supervise() {
+	err := e.waitCmd()
+
+	e.cmdWaitErr <- err
+	close(e.done)
+}
+
+// waitCmd waits for the underlying process, restarting it as needed,
+// and returns the error of its last run
+func (e *executor) waitCmd() error {
+	restarts := newRestartTracker(e.opts.Restart)
+
+	for {
+		err := procReaper.Wait(e.cmd)
+
+		if e.pty != nil {
+			e.pty.wait(outputWaitDelay)
+		}
+
+		for _, o := range e.outputs {
+			o.Flush()
+		}
+
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// the process exited successfully but its output was
+			// still held open by one of its children
+			e.log.Debug("command output was not closed in time")
+			err = nil
+		}
+
+		e.mu.Lock()
+		e.running = false
+		ignoreCmdFailures := e.stopping || e.ctx.Err() != nil
+		e.mu.Unlock()
 
-	go func() {
-		err := e.cmd.Wait()
-		ctxErr := e.ctx.Err()
-		ignoreCmdFailures := ctxErr != nil || ctxErr == context.Canceled
 		e.log.Debug("command exited", "error", err, "ignore-cmd-errors", ignoreCmdFailures)
 
-		if !ignoreCmdFailures {
-			if eerr, ok := err.(*exec.ExitError); ok {
-				if eerr.ExitCode() != 0 {
-					e.log.Error("command error", "exit-code", eerr.ExitCode())
-					if e.onCmdFailureCb != nil {
-						e.onCmdFailureCb(eerr)
-					}
-				}
+		if ignoreCmdFailures {
+			return err
+		}
+
+		if cb := e.callbacks().onCmdExit; cb != nil {
+			cb(err)
+		}
+
+		if !restarts.shouldRestart(err) {
+			e.ended(err)
+			return err
+		}
+
+		delay, ok := restarts.next(time.Now())
+		if !ok {
+			e.log.Error("command restart limit reached", "max-restarts", e.opts.Restart.MaxRestarts, "restart-window", e.opts.Restart.Window)
+			e.ended(err)
+			return err
+		}
+
+		e.log.Warn("restarting command", "error", err, "backoff", delay, "restart-count", restarts.count())
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-e.ctx.Done():
+		case <-e.stopC:
+		}
+		t.Stop()
+
+		if startErr := e.startCmd(); startErr != nil {
+			if !errors.Is(startErr, errExecutorStopping) {
+				e.log.Error("restarting command", "error", startErr)
+				e.ended(newExitCodeError(ExitCodeStartError, fmt.Errorf("restarting command: %w", startErr)))
 			}
+			return err
+		}
+
+		if cb := e.callbacks().onCmdStart; cb != nil {
+			cb()
 		}
+	}
+}
 
-		e.cmdWaitErr <- err
-	}()
+// runningPTY returns the PTY of the running process, if any
+func (e *executor) runningPTY() *ptySession {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	return nil
+	if !e.running {
+		return nil
+	}
+
+	return e.pty
+}
+
+// ended invokes the end callback once the command has exited
+// on its own and will not be restarted
+func (e *executor) ended(err error) {
+	var eerr *exec.ExitError
+	switch {
+	case err == nil:
+		e.log.Warn("command has ended", "exit-code", 0)
+	case errors.As(err, &eerr):
+		e.log.Error("command has ended", "exit-code", cmdExitCode(eerr))
+	default:
+		e.log.Error("command has ended", "error", err)
+	}
+
+	if cb := e.callbacks().onCmdEnd; cb != nil {
+		cb(err)
+	}
+}
+
+// signal delivers sig to the underlying process, or to its whole
+// process group when SignalProcessGroup is enabled
+func (e *executor) signal(cmd *exec.Cmd, sig syscall.Signal) error {
+	if e.opts.SignalProcessGroup {
+		// Setsid makes the child the leader of its own process group
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+
+	return cmd.Process.Signal(sig)
+}
+
+// waitProcessGroup polls the process group of the underlying process
+// until every member is gone. It returns false if timeout fires first.
+func (e *executor) waitProcessGroup(cmd *exec.Cmd, timeout <-chan time.Time) bool {
+	ticker := time.NewTicker(processGroupPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := syscall.Kill(-cmd.Process.Pid, 0); err == syscall.ESRCH {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// stopProcessGroup stops the members of the process group left
+// behind by the underlying process once it has exited
+func (e *executor) stopProcessGroup(cmd *exec.Cmd) error {
+	if err := e.signal(cmd, e.opts.StopSignal); err == syscall.ESRCH {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("signaling remaining process group members: %w", err)
+	}
+
+	e.log.Debug("waiting for remaining process group members", "stop-timeout", e.opts.StopTimeout)
+
+	var stopTimeout <-chan time.Time
+	if e.opts.StopTimeout > 0 {
+		t := time.NewTimer(e.opts.StopTimeout)
+		defer t.Stop()
+		stopTimeout = t.C
+	}
+
+	if e.waitProcessGroup(cmd, stopTimeout) {
+		return nil
+	}
+
+	e.log.Warn("stop timeout expired, killing remaining process group members", "stop-timeout", e.opts.StopTimeout)
+
+	if err := e.signal(cmd, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("killing remaining process group members: %w", err)
+	}
+
+	e.waitProcessGroup(cmd, nil)
+
+	return fmt.Errorf("%w (%s)", errCmdKilled, e.opts.StopTimeout)
+}
+
+// Done returns a channel that is closed once the command has
+// exited and will not be restarted
+func (e *executor) Done() <-chan struct{} {
+	return e.done
+}
+
+// Running reports whether the underlying process is running
+func (e *executor) Running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.running
+}
+
+// Pid returns the pid of the underlying process,
+// or zero if it is not running
+func (e *executor) Pid() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running {
+		return 0
+	}
+
+	return e.cmd.Process.Pid
+}
+
+// Signal forwards sig to the underlying process
+func (e *executor) Signal(sig syscall.Signal) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running {
+		return fmt.Errorf("underlying process is not running")
+	}
+
+	e.log.Debug("forwarding signal to underlying process", "signal", sig.String(), "process-group", e.opts.SignalProcessGroup)
+
+	return e.signal(e.cmd, sig)
+}
+
+// Kill sends SIGKILL to the underlying process, or to its whole
+// process group when SignalProcessGroup is enabled
+func (e *executor) Kill() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running {
+		return nil
+	}
+
+	e.log.Warn("killing underlying process", "process-group", e.opts.SignalProcessGroup)
+
+	return e.signal(e.cmd, syscall.SIGKILL)
 }
 
-// TODO: Allow to send a customized signal
 func (e *executor) Stop() error {
-	if e.cmd.Process == nil {
+	e.mu.Lock()
+	cmd, running, alreadyStopping := e.cmd, e.running, e.stopping
+	e.stopping = true
+	e.mu.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
 		return fmt.Errorf("empty process")
 	}
 
-	e.log.Debug("signaling underlying process")
+	if !alreadyStopping {
+		close(e.stopC)
+	}
 
-	if err := e.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if !running {
+		// the process has already exited and was not restarted
+		e.log.Debug("underlying process is not running")
+		waitErr := <-e.cmdWaitErr
+
+		if e.opts.SignalProcessGroup {
+			if err := e.stopProcessGroup(cmd); err != nil {
+				return err
+			}
+		}
+
+		if waitErr != nil {
+			return fmt.Errorf("waiting for underlying process: %w", waitErr)
+		}
+		return nil
+	}
+
+	e.log.Debug("signaling underlying process", "signal", e.opts.StopSignal.String(), "process-group", e.opts.SignalProcessGroup)
+
+	if err := e.signal(cmd, e.opts.StopSignal); err != nil {
 		return fmt.Errorf("signaling underlying process: %w", err)
 	}
 
-	e.log.Debug("waiting for underlying process")
+	e.log.Debug("waiting for underlying process", "stop-timeout", e.opts.StopTimeout)
+
+	var stopTimeout <-chan time.Time
+	if e.opts.StopTimeout > 0 {
+		t := time.NewTimer(e.opts.StopTimeout)
+		defer t.Stop()
+		stopTimeout = t.C
+	}
+
+	var waitErr error
+	cmdExited := false
+
+	select {
+	case waitErr = <-e.cmdWaitErr:
+		cmdExited = true
+	case <-stopTimeout:
+	}
+
+	stopped := cmdExited
+	if cmdExited && e.opts.SignalProcessGroup {
+		e.log.Debug("waiting for remaining process group members")
+		stopped = e.waitProcessGroup(cmd, stopTimeout)
+	}
+
+	if !stopped {
+		e.log.Warn("stop timeout expired, killing underlying process", "stop-timeout", e.opts.StopTimeout, "process-group", e.opts.SignalProcessGroup)
+
+		if err := e.signal(cmd, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("killing underlying process: %w", err)
+		}
+
+		if !cmdExited {
+			<-e.cmdWaitErr
+		}
+
+		if e.opts.SignalProcessGroup {
+			e.waitProcessGroup(cmd, nil)
+		}
+
+		return fmt.Errorf("%w (%s)", errCmdKilled, e.opts.StopTimeout)
+	}
 
-	if err := <-e.cmdWaitErr; err != nil {
-		return fmt.Errorf("waiting for underlying process: %w", err)
+	if waitErr != nil {
+		return fmt.Errorf("waiting for underlying process: %w", waitErr)
 	}
 
 	e.log.Debug("underlying process has exited")
@@ -0,0 +1,147 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Exit codes reserved for delth's own failures.
+// Any other exit code is the one of the wrapped command, or 128+N
+// if the wrapped command was killed by signal N.
+const (
+	// ExitCodeInternalError is used for any unexpected delth failure
+	ExitCodeInternalError = 120
+	// ExitCodeConfigError is used when delth configuration or
+	// command line is invalid
+	ExitCodeConfigError = 121
+	// ExitCodeListenError is used when the health check proxy
+	// is unable to bind its listening address
+	ExitCodeListenError = 122
+	// ExitCodeStartError is used when the wrapped command
+	// could not be started
+	ExitCodeStartError = 123
+	// ExitCodeHookError is used when a lifecycle hook
+	// with a 'fail' error policy has failed
+	ExitCodeHookError = 124
+	// ExitCodeStartupTimeout is used when the backend has not
+	// been healthy within the startup timeout
+	ExitCodeStartupTimeout = 125
+)
+
+// exitCodeError associates a delth failure with the exit code
+// that delth must terminate with
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func newExitCodeError(code int, err error) *exitCodeError {
+	return &exitCodeError{
+		code: code,
+		err:  err,
+	}
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// exitErrorHolder holds the error delth terminates with,
+// it is safe for concurrent use
+type exitErrorHolder struct {
+	mu  sync.Mutex
+	err error
+}
+
+// Set records err, replacing any previously recorded error
+func (h *exitErrorHolder) Set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.err = err
+}
+
+// SetIfNone records err unless an error is already recorded
+func (h *exitErrorHolder) SetIfNone(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err == nil {
+		h.err = err
+	}
+}
+
+// Get returns the recorded error, if any
+func (h *exitErrorHolder) Get() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+// cmdExitCode returns the exit code of an exited command, using
+// the conventional 128+N when the command was killed by signal N
+func cmdExitCode(eerr *exec.ExitError) int {
+	if status, ok := eerr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return eerr.ExitCode()
+}
+
+// exitCodeFromError returns the exit code delth should terminate with
+// when rootCmdRunE returned err
+func exitCodeFromError(err error) int {
+	var cerr *exitCodeError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+
+	if errors.Is(err, errCmdKilled) {
+		return 128 + int(syscall.SIGKILL)
+	}
+
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) {
+		return cmdExitCode(eerr)
+	}
+
+	return ExitCodeInternalError
+}
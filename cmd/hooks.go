@@ -0,0 +1,274 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+type hookPhase string
+
+const (
+	hookPreStart  hookPhase = "pre_start"
+	hookPostStart hookPhase = "post_start"
+	hookPreStop   hookPhase = "pre_stop"
+	hookPostStop  hookPhase = "post_stop"
+	// hookShutdown is the phase of hooks run by a shutdown timeline
+	hookShutdown hookPhase = "shutdown"
+)
+
+const (
+	hookOnErrorFail   = "fail"
+	hookOnErrorIgnore = "ignore"
+)
+
+// maximum number of bytes of an HTTP hook response body that are logged
+const hookMaxLoggedBody = 512
+
+type hookHTTPConfig struct {
+	Method string `mapstructure:"method"`
+	Scheme string `mapstructure:"scheme"`
+	Port   int    `mapstructure:"port"`
+	Path   string `mapstructure:"path"`
+}
+
+type hookConfig struct {
+	Name    string         `mapstructure:"name"`
+	Exec    []string       `mapstructure:"exec"`
+	HTTP    hookHTTPConfig `mapstructure:"http"`
+	Timeout time.Duration  `mapstructure:"timeout"`
+	OnError string         `mapstructure:"on_error" validate:"omitempty,oneof=fail ignore"`
+}
+
+func (c hookConfig) isHTTP() bool {
+	return c.HTTP.Port != 0 || c.HTTP.Path != ""
+}
+
+type hooksConfig struct {
+	// Timeout applies to hooks that do not define their own
+	Timeout   time.Duration `mapstructure:"timeout"`
+	PreStart  []hookConfig  `mapstructure:"pre_start" validate:"dive"`
+	PostStart []hookConfig  `mapstructure:"post_start" validate:"dive"`
+	PreStop   []hookConfig  `mapstructure:"pre_stop" validate:"dive"`
+	PostStop  []hookConfig  `mapstructure:"post_stop" validate:"dive"`
+}
+
+func (c hooksConfig) byPhase() map[hookPhase][]hookConfig {
+	return map[hookPhase][]hookConfig{
+		hookPreStart:  c.PreStart,
+		hookPostStart: c.PostStart,
+		hookPreStop:   c.PreStop,
+		hookPostStop:  c.PostStop,
+	}
+}
+
+// validateHooks checks hooks that can not be validated with struct tags
+func validateHooks(cfg hooksConfig) error {
+	for phase, hooks := range cfg.byPhase() {
+		for i, h := range hooks {
+			if err := validateHook(h); err != nil {
+				return fmt.Errorf("%s hook #%d: %w", phase, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateHook(h hookConfig) error {
+	if (len(h.Exec) > 0) == h.isHTTP() {
+		return errors.New("exactly one of 'exec' or 'http' must be set")
+	}
+
+	if h.isHTTP() && h.HTTP.Port == 0 {
+		return errors.New("missing HTTP port")
+	}
+
+	return nil
+}
+
+type hookRunner struct {
+	hooks          map[hookPhase][]hookConfig
+	env            []string
+	defaultTimeout time.Duration
+	log            *slog.Logger
+	hClient        httpDoer
+}
+
+// NewHookRunner returns a runner of the hooks of cfg, whose
+// commands are run with env, the environment of wrapped commands
+func NewHookRunner(cfg hooksConfig, env []string) *hookRunner {
+	return &hookRunner{
+		hooks:          cfg.byPhase(),
+		env:            env,
+		defaultTimeout: cfg.Timeout,
+		log:            slog.Default().With("component", "hooks"),
+		hClient:        http.DefaultClient,
+	}
+}
+
+// Run runs every hook of phase in order. It stops at the first failing
+// hook whose error policy is 'fail' and returns its error.
+func (r *hookRunner) Run(ctx context.Context, phase hookPhase, env []string) error {
+	for i, h := range r.hooks[phase] {
+		name := h.Name
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", phase, i)
+		}
+
+		if err := r.RunHook(ctx, phase, name, h, env); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunHook runs the single hook h as part of phase. Its error
+// is only returned if its error policy is 'fail'.
+func (r *hookRunner) RunHook(ctx context.Context, phase hookPhase, name string, h hookConfig, env []string) error {
+	log := r.log.With("hook-phase", string(phase), "hook", name)
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = r.defaultTimeout
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Info("running hook")
+	start := time.Now()
+
+	var err error
+	if h.isHTTP() {
+		err = r.runHTTP(hookCtx, log, h)
+	} else {
+		err = r.runExec(hookCtx, log, phase, h, env)
+	}
+
+	if err == nil {
+		log.Info("hook succeeded", "duration", time.Since(start))
+		return nil
+	}
+
+	if h.OnError == hookOnErrorIgnore {
+		log.Warn("hook failed, ignoring", "duration", time.Since(start), "error", err)
+		return nil
+	}
+
+	log.Error("hook failed", "duration", time.Since(start), "error", err)
+
+	return fmt.Errorf("%s hook %q: %w", phase, name, err)
+}
+
+func (r *hookRunner) runExec(ctx context.Context, log *slog.Logger, phase hookPhase, h hookConfig, env []string) error {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+	cmd.Env = append(slices.Clip(r.env), "DELTH_HOOK_PHASE="+string(phase))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := procReaper.Start(cmd); err != nil {
+		return err
+	}
+
+	err := procReaper.Wait(cmd)
+
+	logHookOutput(log, "stdout", &stdout)
+	logHookOutput(log, "stderr", &stderr)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out: %w", err)
+	}
+
+	return err
+}
+
+func logHookOutput(log *slog.Logger, stream string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Info("hook output", "stream", stream, "line", scanner.Text())
+	}
+}
+
+func (r *hookRunner) runHTTP(ctx context.Context, log *slog.Logger, h hookConfig) error {
+	return doHookHTTP(ctx, r.hClient, log, h.HTTP)
+}
+
+// doHookHTTP performs the HTTP request described by cfg to the
+// local host and checks its response status
+func doHookHTTP(ctx context.Context, client httpDoer, log *slog.Logger, cfg hookHTTPConfig) error {
+	method := cfg.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://localhost:%d%s", scheme, cfg.Port, cfg.Path), nil)
+	if err != nil {
+		return fmt.Errorf("creating new HTTP request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, hookMaxLoggedBody))
+
+	log.Info("hook HTTP response", "http-status-code", resp.StatusCode, "body", string(body))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsExecArg is the first argument of delth when it is run in
+// place of a command receiving listening sockets: the LISTEN_PID
+// variable of the LISTEN_FDS protocol must be the pid of the command,
+// which is only known once it is started. It is not a subcommand so
+// that any command can be wrapped without '--'.
+const listenFDsExecArg = "__delth-listen-fds-exec"
+
+// listenFDsExec replaces delth by the command of args, made of its
+// path, argv0 and arguments, once LISTEN_PID is set
+func listenFDsExec(args []string) error {
+	if len(args) < 2 {
+		return newExitCodeError(ExitCodeInternalError, errors.New("missing command to execute"))
+	}
+
+	path := args[0]
+	env := setEnv(os.Environ(), "LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	if err := syscall.Exec(path, args[1:], env); err != nil {
+		return newExitCodeError(ExitCodeStartError, fmt.Errorf("executing %q: %w", path, err))
+	}
+
+	return nil
+}
+
+// openListenFiles binds every address of addrs and returns the
+// resulting sockets, to be handed over to the main process. Addresses
+// prefixed with 'unix:' are Unix socket paths, others TCP addresses.
+func openListenFiles(addrs []string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(addrs))
+
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for _, addr := range addrs {
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", path
+		}
+
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		f, err := listenerFile(ln)
+		// the file is a duplicate of the listener socket
+		ln.Close()
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("getting %q socket: %w", addr, err)
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// keep the socket file when closing our listener
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+
+	return nil, errors.ErrUnsupported
+}
+
+// listenFDsCmd rewrites cmd so that it receives files as listening
+// sockets following the systemd LISTEN_FDS protocol
+func listenFDsCmd(cmd *exec.Cmd, files []*os.File) {
+	if cmd.Err != nil {
+		// let cmd.Start() report the lookup error
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	cmd.Args = append([]string{self, listenFDsExecArg, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.ExtraFiles = files
+
+	cmd.Env = unsetEnv(cmd.Env, "LISTEN_PID")
+	cmd.Env = unsetEnv(cmd.Env, "LISTEN_FDNAMES")
+	cmd.Env = setEnv(cmd.Env, "LISTEN_FDS", strconv.Itoa(len(files)))
+}
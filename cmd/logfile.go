@@ -0,0 +1,290 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffixLayout is the time layout appended to rotated files
+const rotatedSuffixLayout = "20060102-150405.000"
+
+type LogFileOptions struct {
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated.
+	// Zero disables size based rotation.
+	MaxSize int64
+	// MaxAge is the age after which the file is rotated.
+	// Zero disables age based rotation.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files to keep.
+	// Zero keeps all of them.
+	MaxFiles int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// rotatingFile is an io.Writer to a file rotated on size and age
+type rotatingFile struct {
+	opts LogFileOptions
+	log  *slog.Logger
+
+	// cleanupMu serializes cleanups of rotated files
+	cleanupMu sync.Mutex
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(opts LogFileOptions) (*rotatingFile, error) {
+	r := &rotatingFile{
+		opts: opts,
+		log:  slog.Default().With("component", "log-file", "path", opts.Path),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = fi.Size()
+	r.openedAt = time.Now()
+
+	return nil
+}
+
+// Write never fails, errors are logged instead so that a failing log
+// file never interrupts the output of the command
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return len(p), nil
+	}
+
+	if r.size > 0 && r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			r.log.Error("rotating log file", "error", err)
+			if r.file == nil {
+				return len(p), nil
+			}
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	if err != nil {
+		r.log.Error("writing log file", "error", err)
+	}
+
+	return len(p), nil
+}
+
+func (r *rotatingFile) shouldRotate(incoming int64) bool {
+	if r.opts.MaxSize > 0 && r.size+incoming > r.opts.MaxSize {
+		return true
+	}
+
+	return r.opts.MaxAge > 0 && time.Since(r.openedAt) > r.opts.MaxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		r.log.Debug("closing log file", "error", err)
+	}
+
+	rotated := r.opts.Path + "." + time.Now().Format(rotatedSuffixLayout)
+	if err := os.Rename(r.opts.Path, rotated); err != nil {
+		// keep on writing to the current file
+		if openErr := r.open(); openErr != nil {
+			r.file = nil
+			return openErr
+		}
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		r.file = nil
+		return err
+	}
+
+	r.log.Debug("log file rotated", "rotated", rotated)
+
+	go r.cleanup(rotated)
+
+	return nil
+}
+
+// cleanup compresses the newly rotated file if needed and removes
+// rotated files in excess
+func (r *rotatingFile) cleanup(rotated string) {
+	r.cleanupMu.Lock()
+	defer r.cleanupMu.Unlock()
+
+	if r.opts.Compress {
+		// the rotated file may already have been removed
+		// by the cleanup of a more recent one
+		if err := gzipFile(rotated); err != nil && !os.IsNotExist(err) {
+			r.log.Error("compressing rotated log file", "rotated", rotated, "error", err)
+		}
+	}
+
+	if r.opts.MaxFiles <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.opts.Path + ".*")
+	if err != nil {
+		r.log.Error("listing rotated log files", "error", err)
+		return
+	}
+
+	// rotated files names sort chronologically
+	rotatedFiles := []string{}
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			rotatedFiles = append(rotatedFiles, m)
+		}
+	}
+	sort.Strings(rotatedFiles)
+
+	for len(rotatedFiles) > r.opts.MaxFiles {
+		if err := os.Remove(rotatedFiles[0]); err != nil {
+			r.log.Error("removing rotated log file", "rotated", rotatedFiles[0], "error", err)
+		}
+		rotatedFiles = rotatedFiles[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Reopen closes and reopens the file, to be used after
+// the file has been rotated by an external tool
+func (r *rotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			r.log.Debug("closing log file", "error", err)
+		}
+	}
+
+	if err := r.open(); err != nil {
+		r.file = nil
+		return fmt.Errorf("reopening log file %q: %w", r.opts.Path, err)
+	}
+
+	r.log.Debug("log file reopened")
+
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
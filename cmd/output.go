@@ -0,0 +1,189 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+)
+
+// How lines that are JSON objects are handled when capturing output
+const (
+	// JSONLinesMerge logs the fields of the JSON object as attributes
+	JSONLinesMerge = "merge"
+	// JSONLinesPassthrough writes the JSON object unchanged
+	JSONLinesPassthrough = "passthrough"
+	// JSONLinesText handles JSON lines like any other line
+	JSONLinesText = "text"
+)
+
+// maximum size of a captured line, longer lines are split
+const maxCapturedLineSize = 64 * 1024
+
+// lineLogger is an io.Writer that re-emits every line written
+// to it as a log record
+type lineLogger struct {
+	stream    string
+	cmd       *exec.Cmd
+	jsonLines string
+	log       *slog.Logger
+	out       io.Writer
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLineLogger(log *slog.Logger, cmd *exec.Cmd, stream string, jsonLines string, out io.Writer) *lineLogger {
+	return &lineLogger{
+		stream:    stream,
+		cmd:       cmd,
+		jsonLines: jsonLines,
+		log:       log,
+		out:       out,
+	}
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	for {
+		idx := bytes.IndexByte(l.buf, '\n')
+		if idx < 0 {
+			if len(l.buf) >= maxCapturedLineSize {
+				l.emit(l.buf)
+				l.buf = l.buf[:0]
+			}
+			break
+		}
+
+		l.emit(l.buf[:idx])
+		l.buf = l.buf[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush emits any pending partial line
+func (l *lineLogger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) > 0 {
+		l.emit(l.buf)
+		l.buf = nil
+	}
+}
+
+func (l *lineLogger) emit(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	attrs := []slog.Attr{
+		slog.String("stream", l.stream),
+	}
+	if l.cmd.Process != nil {
+		attrs = append(attrs, slog.Int("pid", l.cmd.Process.Pid))
+	}
+
+	if l.jsonLines != JSONLinesText && len(line) > 0 && line[0] == '{' && json.Valid(line) {
+		if l.jsonLines == JSONLinesPassthrough {
+			fmt.Fprintf(l.out, "%s\n", line)
+			return
+		}
+
+		var fields map[string]any
+		if err := json.Unmarshal(line, &fields); err == nil {
+			l.emitMerged(attrs, fields)
+			return
+		}
+	}
+
+	l.log.LogAttrs(context.Background(), slog.LevelInfo, string(line), attrs...)
+}
+
+// emitMerged logs a JSON object line, using its message and level
+// fields if any and its other fields as attributes
+func (l *lineLogger) emitMerged(attrs []slog.Attr, fields map[string]any) {
+	msg := ""
+	for _, key := range []string{"msg", "message"} {
+		if v, ok := fields[key].(string); ok {
+			msg = v
+			delete(fields, key)
+			break
+		}
+	}
+
+	level := slog.LevelInfo
+	for _, key := range []string{"level", "severity"} {
+		if v, ok := fields[key].(string); ok {
+			if err := level.UnmarshalText([]byte(v)); err == nil {
+				delete(fields, key)
+			}
+			break
+		}
+	}
+
+	delete(fields, "time")
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+
+	l.log.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// captureOutput redirects the output of cmd to line loggers
+func captureOutput(log *slog.Logger, cmd *exec.Cmd, jsonLines string) []*lineLogger {
+	stdout := newLineLogger(log, cmd, "stdout", jsonLines, os.Stdout)
+	stderr := newLineLogger(log, cmd, "stderr", jsonLines, os.Stderr)
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	return []*lineLogger{stdout, stderr}
+}
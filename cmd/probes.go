@@ -0,0 +1,183 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProbeDrainOptions controls when load balancers are considered
+// to have noticed that delth is draining
+type ProbeDrainOptions struct {
+	// Responses is the number of unhealthy responses every prober
+	// must have received
+	Responses int
+	// QuietPeriod is the delay after which a prober that stopped
+	// probing is not waited for anymore
+	QuietPeriod time.Duration
+	// Window is how recently a prober must have been seen before
+	// the drain started to be waited for
+	Window time.Duration
+}
+
+type prober struct {
+	lastSeen  time.Time
+	unhealthy int
+}
+
+// probeTracker records the health check probers, identified
+// by their remote address, and the responses they received
+type probeTracker struct {
+	opts ProbeDrainOptions
+	log  *slog.Logger
+
+	mu      sync.Mutex
+	probers map[string]*prober
+}
+
+func newProbeTracker(opts ProbeDrainOptions) *probeTracker {
+	return &probeTracker{
+		opts:    opts,
+		log:     slog.Default().With("component", "probe-tracker"),
+		probers: make(map[string]*prober),
+	}
+}
+
+// Record records a probe from remoteAddr that was answered with
+// status. Unhealthy responses only count when shuttingDown.
+func (t *probeTracker) Record(remoteAddr string, status int, shuttingDown bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.probers[host]
+	if !ok {
+		p = &prober{}
+		t.probers[host] = p
+	}
+
+	p.lastSeen = now
+	if shuttingDown && status == http.StatusServiceUnavailable {
+		p.unhealthy++
+	}
+
+	for addr, p := range t.probers {
+		if now.Sub(p.lastSeen) > t.opts.Window {
+			delete(t.probers, addr)
+		}
+	}
+}
+
+// pending returns the probers seen within the window before since
+// that neither received enough unhealthy responses nor went quiet
+func (t *probeTracker) pending(since time.Time, now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var addrs []string
+	for addr, p := range t.probers {
+		switch {
+		case p.lastSeen.Before(since.Add(-t.opts.Window)):
+		case p.unhealthy >= t.opts.Responses:
+		case now.Sub(p.lastSeen) >= t.opts.QuietPeriod:
+		default:
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// Drained returns a channel that is closed once every prober seen
+// recently before since has noticed delth is draining
+func (t *probeTracker) Drained(ctx context.Context, since time.Time) <-chan struct{} {
+	drained := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+
+		last := -1
+		for {
+			pending := t.pending(since, time.Now())
+			if len(pending) == 0 {
+				t.log.Info("every prober has noticed delth is draining")
+				close(drained)
+				return
+			}
+
+			if len(pending) != last {
+				t.log.Info("waiting for probers to notice delth is draining", "pending-probers", pending)
+				last = len(pending)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return drained
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
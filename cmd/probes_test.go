@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riton/delth/internal/lifecycle"
+)
+
+func newTestProbeTracker() *probeTracker {
+	return newProbeTracker(ProbeDrainOptions{
+		Responses:   2,
+		QuietPeriod: time.Minute,
+		Window:      time.Minute,
+	})
+}
+
+func TestProbeTrackerPending(t *testing.T) {
+	tr := newTestProbeTracker()
+	since := time.Now()
+
+	tr.Record("192.0.2.1:1234", http.StatusOK, false)
+	tr.Record("192.0.2.2:1234", http.StatusOK, false)
+
+	if got := tr.pending(since, time.Now()); len(got) != 2 {
+		t.Fatalf("expected 2 pending probers, got %v", got)
+	}
+
+	// unhealthy responses only count once shutting down
+	tr.Record("192.0.2.1:1234", http.StatusServiceUnavailable, false)
+	tr.Record("192.0.2.1:1234", http.StatusServiceUnavailable, true)
+	tr.Record("192.0.2.1:5678", http.StatusServiceUnavailable, true)
+	tr.Record("192.0.2.2:1234", http.StatusServiceUnavailable, true)
+
+	if got := tr.pending(since, time.Now()); !slices.Equal(got, []string{"192.0.2.2"}) {
+		t.Fatalf("expected 192.0.2.2 to be pending, got %v", got)
+	}
+
+	if got := tr.pending(since, time.Now().Add(time.Minute)); len(got) != 0 {
+		t.Fatalf("expected quiet probers not to be pending, got %v", got)
+	}
+}
+
+type okDoer struct{}
+
+func (okDoer) Do(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("ok\n")),
+	}, nil
+}
+
+func TestHealthHandlerIgnoreShuttingDownStateIsNotAProbe(t *testing.T) {
+	tr := newTestProbeTracker()
+	since := time.Now()
+
+	h := NewHealthCheckProxy(context.Background(), HealthCheckProxyOptions{
+		RealHealthCheckPath:   "/health",
+		RealHealthCheckPort:   8080,
+		RealHealthCheckScheme: "http",
+	})
+	h.SetHTTPClient(okDoer{})
+	h.SetProbeTracker(tr)
+	h.SetLifecycleState(lifecycle.Transition{From: lifecycle.Ready, To: lifecycle.Draining})
+
+	probe := func(remoteAddr, target string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.HealthHandler(w, r)
+		return w.Code
+	}
+
+	for range 3 {
+		if code := probe("192.0.2.1:1234", "/health?delth.ignoreShuttingDownState=1"); code != http.StatusOK {
+			t.Fatalf("expected the backend status, got %d", code)
+		}
+	}
+
+	if got := tr.pending(since, time.Now()); len(got) != 0 {
+		t.Fatalf("expected requests ignoring the shutting down state not to be recorded, got %v", got)
+	}
+
+	if code := probe("192.0.2.2:1234", "/health"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d while draining, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if got := tr.pending(since, time.Now()); !slices.Equal(got, []string{"192.0.2.2"}) {
+		t.Fatalf("expected 192.0.2.2 to be pending, got %v", got)
+	}
+
+	probe("192.0.2.2:1234", "/health")
+
+	if got := tr.pending(since, time.Now()); len(got) != 0 {
+		t.Fatalf("expected every prober to have noticed the drain, got %v", got)
+	}
+}
@@ -38,14 +38,20 @@ import (
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync/atomic"
+
+	"github.com/riton/delth/internal/lifecycle"
 )
 
 type healthCheckProxy struct {
-	opts         HealthCheckProxyOptions
-	shuttingDown bool
-	ctx          context.Context
-	log          *slog.Logger
-	hClient      httpDoer
+	opts          HealthCheckProxyOptions
+	state         atomic.Int32
+	backendDown   atomic.Bool
+	backendExited atomic.Bool
+	ctx           context.Context
+	log           *slog.Logger
+	hClient       httpDoer
+	probes        *probeTracker
 }
 
 type httpDoer interface {
@@ -56,6 +62,10 @@ type HealthCheckProxyOptions struct {
 	RealHealthCheckPath   string
 	RealHealthCheckPort   int
 	RealHealthCheckScheme string
+	// StartingStatus and StartingBody are the response to health
+	// checks until the backend has been healthy once
+	StartingStatus int
+	StartingBody   string
 }
 
 func NewHealthCheckProxy(ctx context.Context, opts HealthCheckProxyOptions) *healthCheckProxy {
@@ -70,6 +80,12 @@ func (h *healthCheckProxy) SetHTTPClient(c httpDoer) {
 	h.hClient = c
 }
 
+// SetProbeTracker records every health check probe in t.
+// It must be called before serving requests.
+func (h *healthCheckProxy) SetProbeTracker(t *probeTracker) {
+	h.probes = t
+}
+
 func (h *healthCheckProxy) getHTTPClient() httpDoer {
 	if h.hClient == nil {
 		return http.DefaultClient
@@ -78,15 +94,68 @@ func (h *healthCheckProxy) getHTTPClient() httpDoer {
 	return h.hClient
 }
 
-func (h *healthCheckProxy) InitiateShutdown() {
-	h.shuttingDown = true
+// SetLifecycleState records the lifecycle state of delth, it is
+// meant to be subscribed to the lifecycle state machine
+func (h *healthCheckProxy) SetLifecycleState(t lifecycle.Transition) {
+	h.state.Store(int32(t.To))
+}
+
+// SetBackendDown marks the backend as down (e.g. while it is
+// waiting to be restarted) or back up
+func (h *healthCheckProxy) SetBackendDown(down bool) {
+	h.backendDown.Store(down)
+}
+
+// SetBackendExited marks the backend as having exited for good,
+// or as running again
+func (h *healthCheckProxy) SetBackendExited(exited bool) {
+	h.backendExited.Store(exited)
+}
+
+func (h *healthCheckProxy) newBackendRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://localhost:%d%s", h.opts.RealHealthCheckScheme, h.opts.RealHealthCheckPort, h.opts.RealHealthCheckPath), body)
+}
+
+// CheckBackend performs the backend health check and
+// returns an error if it does not succeed
+func (h *healthCheckProxy) CheckBackend(ctx context.Context) error {
+	req, err := h.newBackendRequest(ctx, http.MethodGet, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.getHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("backend health check returned HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
 }
 
 func (h *healthCheckProxy) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	log := h.log.With("component", "http-health-handler")
 
-	if r.URL.Query().Get("delth.ignoreShuttingDownState") != "1" {
-		if h.shuttingDown {
+	ignoreShuttingDown := r.URL.Query().Get("delth.ignoreShuttingDownState") == "1"
+
+	// requests ignoring the shutting down state never get the
+	// unhealthy response a prober is waited for, they are not probes
+	if h.probes != nil && !ignoreShuttingDown {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			h.probes.Record(r.RemoteAddr, rec.status, lifecycle.State(h.state.Load()).ShuttingDown())
+		}()
+	}
+
+	if !ignoreShuttingDown {
+		if lifecycle.State(h.state.Load()).ShuttingDown() {
 			log.Debug("responding service is shutting down")
 			w.WriteHeader(http.StatusServiceUnavailable)
 			fmt.Fprintf(w, "delth: service is shutting down\n")
@@ -94,11 +163,32 @@ func (h *healthCheckProxy) HealthHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	if lifecycle.State(h.state.Load()) == lifecycle.Starting {
+		log.Debug("responding service is starting")
+		w.WriteHeader(h.opts.StartingStatus)
+		fmt.Fprint(w, h.opts.StartingBody)
+		return
+	}
+
+	if h.backendExited.Load() {
+		log.Debug("responding backend has exited")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "delth: backend exited\n")
+		return
+	}
+
+	if h.backendDown.Load() {
+		log.Debug("responding backend is down")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "delth: backend is down\n")
+		return
+	}
+
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
 
-	req, err := http.NewRequestWithContext(h.ctx, r.Method, fmt.Sprintf("%s://localhost:%d%s", h.opts.RealHealthCheckScheme, h.opts.RealHealthCheckPort, h.opts.RealHealthCheckPath), r.Body)
+	req, err := h.newBackendRequest(h.ctx, r.Method, r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Error("creating new HTTP request", "error", err)
@@ -0,0 +1,217 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ptySession is the pseudo-terminal allocated to one run
+// of the underlying process
+type ptySession struct {
+	master *os.File
+	tty    *os.File
+	output io.Writer
+	done   chan struct{}
+}
+
+// attachPTY allocates a pseudo-terminal and makes it the standard
+// input, output, error and controlling terminal of cmd. What cmd
+// writes to it is copied to the previous cmd.Stdout.
+func attachPTY(cmd *exec.Cmd) (*ptySession, error) {
+	master, tty, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+
+	if isTerminal(os.Stdin) {
+		if err := copyWinsize(os.Stdin, tty); err != nil {
+			slog.Debug("setting PTY window size", "error", err)
+		}
+	}
+
+	p := &ptySession{
+		master: master,
+		tty:    tty,
+		output: cmd.Stdout,
+		done:   make(chan struct{}),
+	}
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+
+	// with Setsid, Ctty is a file descriptor number in the child
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	return p, nil
+}
+
+// started releases the terminal side of the PTY once the underlying
+// process holds it and starts copying its output
+func (p *ptySession) started() {
+	p.tty.Close()
+
+	go func() {
+		defer close(p.done)
+		// reading the master side fails with EIO once every
+		// process holding the terminal side is gone
+		io.Copy(p.output, p.master)
+	}()
+}
+
+// wait waits at most timeout for the output of the PTY
+// to be copied and releases it
+func (p *ptySession) wait(timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-p.done:
+	case <-t.C:
+	}
+
+	p.master.Close()
+}
+
+// Close releases both sides of the PTY
+func (p *ptySession) Close() error {
+	return errors.Join(p.tty.Close(), p.master.Close())
+}
+
+// resize propagates the window size of delth terminal to the PTY
+func (p *ptySession) resize() error {
+	return copyWinsize(os.Stdin, p.master)
+}
+
+// terminalForwarder puts delth terminal in raw mode and forwards its
+// input and window size changes to the PTY returned by target. It is
+// set up once for every generation of a process: a second raw mode
+// would save the already raw state, and a second reader would steal
+// input meant for the running generation.
+type terminalForwarder struct {
+	target func() *ptySession
+	log    *slog.Logger
+
+	restore func() error
+	stopC   chan struct{}
+	once    sync.Once
+}
+
+func newTerminalForwarder(target func() *ptySession) *terminalForwarder {
+	return &terminalForwarder{
+		target: target,
+		log:    slog.Default().With("component", "terminal"),
+		stopC:  make(chan struct{}),
+	}
+}
+
+// Start sets delth terminal in raw mode, if any, and starts forwarding
+func (t *terminalForwarder) Start() {
+	if isTerminal(os.Stdin) {
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			t.log.Warn("setting terminal in raw mode", "error", err)
+		} else {
+			t.restore = restore
+		}
+
+		go t.forwardWinsize()
+	}
+
+	go t.forwardInput()
+}
+
+// Restore stops forwarding window size changes and restores
+// delth terminal. It must be called before delth exits.
+func (t *terminalForwarder) Restore() {
+	t.once.Do(func() {
+		close(t.stopC)
+
+		if t.restore != nil {
+			if err := t.restore(); err != nil {
+				t.log.Warn("restoring terminal", "error", err)
+			}
+		}
+	})
+}
+
+// forwardInput copies delth standard input to the target PTY, if any
+func (t *terminalForwarder) forwardInput() {
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if pty := t.target(); n > 0 && pty != nil {
+			if _, werr := pty.master.Write(buf[:n]); werr != nil {
+				t.log.Debug("forwarding input to PTY", "error", werr)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				t.log.Debug("reading standard input", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// forwardWinsize propagates delth terminal window
+// size changes to the target PTY
+func (t *terminalForwarder) forwardWinsize() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-sigs:
+		case <-t.stopC:
+			return
+		}
+
+		if pty := t.target(); pty != nil {
+			if err := pty.resize(); err != nil {
+				t.log.Debug("resizing PTY", "error", err)
+			}
+		}
+	}
+}
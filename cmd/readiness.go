@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// readinessPollInterval bounds the time a readiness socket
+// read blocks before the context is checked again
+const readinessPollInterval = 250 * time.Millisecond
+
+// readinessSocket receives the notifications of a single process
+// through NOTIFY_SOCKET, as sent by sd_notify(3)
+type readinessSocket struct {
+	dir  string
+	path string
+	conn *net.UnixConn
+}
+
+// newReadinessSocket creates a socket the process running
+// with cred, nil meaning delth identity, can notify
+func newReadinessSocket(cred *cmdCredential) (*readinessSocket, error) {
+	dir, err := os.MkdirTemp("", "delth-notify-")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if cred != nil {
+		for _, p := range []string{dir, path} {
+			if err := os.Chown(p, int(cred.uid), int(cred.gid)); err != nil {
+				conn.Close()
+				os.RemoveAll(dir)
+				return nil, err
+			}
+		}
+	}
+
+	return &readinessSocket{
+		dir:  dir,
+		path: path,
+		conn: conn,
+	}, nil
+}
+
+// Env returns the environment variable pointing a process to s
+func (s *readinessSocket) Env() string {
+	return "NOTIFY_SOCKET=" + s.path
+}
+
+// WaitReady waits for a READY=1 notification
+func (s *readinessSocket) WaitReady(ctx context.Context) error {
+	buf := make([]byte, 4096)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.conn.SetReadDeadline(time.Now().Add(readinessPollInterval)); err != nil {
+			return err
+		}
+
+		n, err := s.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("reading notification: %w", err)
+		}
+
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			if string(line) == "READY=1" {
+				return nil
+			}
+		}
+	}
+}
+
+func (s *readinessSocket) Close() error {
+	err := s.conn.Close()
+	os.RemoveAll(s.dir)
+
+	return err
+}
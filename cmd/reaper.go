@@ -0,0 +1,154 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const reaperScanInterval = 5 * time.Second
+
+// procReaper is shared by every part of delth that spawns processes,
+// so that the zombie reaper never reaps a process somebody is
+// already waiting for
+var procReaper = newReaper()
+
+// reaper reaps orphaned zombie processes that are re-parented to delth
+// when it runs as PID 1 or as a child subreaper. Processes started
+// through it are tracked and left to their own cmd.Wait().
+type reaper struct {
+	mu      sync.Mutex
+	tracked map[int]struct{}
+	log     *slog.Logger
+}
+
+func newReaper() *reaper {
+	return &reaper{
+		tracked: make(map[int]struct{}),
+	}
+}
+
+// Start starts cmd and tracks its process so that it is not reaped
+func (r *reaper) Start(cmd *exec.Cmd) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	r.tracked[cmd.Process.Pid] = struct{}{}
+
+	return nil
+}
+
+// Wait waits for a command started with Start() and stops tracking it
+func (r *reaper) Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	r.mu.Lock()
+	delete(r.tracked, cmd.Process.Pid)
+	r.mu.Unlock()
+
+	return err
+}
+
+// Run reaps zombie processes until ctx is done. If delth is not PID 1,
+// it first registers itself as a child subreaper so that orphaned
+// descendants are re-parented to it.
+func (r *reaper) Run(ctx context.Context) error {
+	// the default logger is only configured by now
+	r.log = slog.Default().With("component", "reaper")
+
+	if os.Getpid() != 1 {
+		if err := setChildSubreaper(); err != nil {
+			return err
+		}
+		r.log.Debug("registered as child subreaper")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+
+	go func() {
+		defer signal.Stop(sigs)
+
+		// SIGCHLD can be coalesced, scan periodically as well
+		ticker := time.NewTicker(reaperScanInterval)
+		defer ticker.Stop()
+
+		for {
+			r.reap()
+
+			select {
+			case <-sigs:
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *reaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pids, err := zombieChildren()
+	if err != nil {
+		r.log.Error("listing zombie processes", "error", err)
+		return
+	}
+
+	for _, pid := range pids {
+		if _, ok := r.tracked[pid]; ok {
+			continue
+		}
+
+		var ws syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err != nil {
+			r.log.Debug("reaping zombie process", "pid", pid, "error", err)
+			continue
+		}
+
+		r.log.Debug("reaped zombie process", "pid", pid, "exit-code", ws.ExitStatus(), "signaled", ws.Signaled())
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// reloadCheckInterval is the delay between two checks of the
+// new generation while waiting for it to be ready
+const reloadCheckInterval = time.Second
+
+// Reload readiness modes, deciding when a new generation of the
+// main process is ready to take over
+const (
+	// ReloadReadyHealth waits for the backend health check to succeed.
+	// Both generations share the listening sockets and the check may
+	// thus be answered by any of them, the new generation is given
+	// ReadyDelay to start beforehand.
+	ReloadReadyHealth = "health"
+	// ReloadReadyNotify waits for the new generation to send READY=1
+	// to NOTIFY_SOCKET, as sd_notify(3) does
+	ReloadReadyNotify = "notify"
+)
+
+type ReloadOptions struct {
+	// Timeout bounds the wait for the new generation to be ready
+	Timeout time.Duration
+	// Ready is the readiness mode, see ReloadReadyHealth and others
+	Ready string
+	// ReadyDelay is the time given to the new generation to start
+	// before health checks are considered in ReloadReadyHealth mode
+	ReadyDelay time.Duration
+}
+
+// reloader replaces the main process by a new generation of it
+// when asked to, one reload at a time
+type reloader struct {
+	supervisor *supervisor
+	proxy      *healthCheckProxy
+	opts       ReloadOptions
+	requests   chan struct{}
+	log        *slog.Logger
+}
+
+func newReloader(s *supervisor, proxy *healthCheckProxy, opts ReloadOptions) *reloader {
+	return &reloader{
+		supervisor: s,
+		proxy:      proxy,
+		opts:       opts,
+		requests:   make(chan struct{}, 1),
+		log:        slog.Default().With("component", "reloader"),
+	}
+}
+
+// Trigger requests a reload. It is a no-op if one
+// is already pending.
+func (r *reloader) Trigger() {
+	select {
+	case r.requests <- struct{}{}:
+	default:
+	}
+}
+
+// Run performs requested reloads until ctx is done
+func (r *reloader) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.requests:
+		}
+
+		start := time.Now()
+
+		if err := r.reload(ctx); err != nil {
+			r.log.Error("reloading main process, keeping the current generation", "error", err)
+			continue
+		}
+
+		r.log.Info("main process reloaded", "duration", time.Since(start))
+	}
+}
+
+func (r *reloader) reload(ctx context.Context) error {
+	rctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+
+	if r.opts.Ready != ReloadReadyNotify {
+		return r.supervisor.Reload(rctx, nil, r.waitHealthy)
+	}
+
+	sock, err := newReadinessSocket(r.supervisor.Main().opts.Credential)
+	if err != nil {
+		return fmt.Errorf("creating readiness notification socket: %w", err)
+	}
+	defer sock.Close()
+
+	return r.supervisor.Reload(rctx, []string{sock.Env()}, func(ctx context.Context, e *executor) error {
+		return r.waitNotified(ctx, e, sock)
+	})
+}
+
+// waitHealthy waits for the backend health check to succeed
+// while the new generation e is running
+func (r *reloader) waitHealthy(ctx context.Context, e *executor) error {
+	ticker := time.NewTicker(reloadCheckInterval)
+	defer ticker.Stop()
+
+	checkAfter := time.Now().Add(r.opts.ReadyDelay)
+
+	for {
+		if !e.Running() {
+			return errors.New("new generation has exited")
+		}
+
+		if !time.Now().Before(checkAfter) {
+			err := r.proxy.CheckBackend(ctx)
+			if err == nil {
+				return nil
+			}
+
+			r.log.Debug("new generation is not ready yet", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("new generation is not ready: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitNotified waits for the new generation e to send READY=1
+// on sock while it is running
+func (r *reloader) waitNotified(ctx context.Context, e *executor, sock *readinessSocket) error {
+	readyCtx, readyCancel := context.WithCancel(ctx)
+	defer readyCancel()
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- sock.WaitReady(readyCtx)
+	}()
+
+	ticker := time.NewTicker(reloadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-ready:
+			if err != nil {
+				return fmt.Errorf("new generation is not ready: %w", err)
+			}
+			return nil
+		case <-ticker.C:
+			if !e.Running() {
+				return errors.New("new generation has exited")
+			}
+			r.log.Debug("new generation is not ready yet")
+		}
+	}
+}
+
+// parseReloadSignal parses the reload signal name, which must
+// not be handled otherwise
+func parseReloadSignal(name string, routing signalRouting) (syscall.Signal, error) {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, ok := routing.relay[sig]; ok || slices.Contains(routing.drain, os.Signal(sig)) || slices.Contains(routing.force, os.Signal(sig)) {
+		return 0, fmt.Errorf("signal %s cannot be both the reload signal and a drain, force or forwarded signal", sig)
+	}
+
+	return sig, nil
+}
+
+// Handler triggers a reload on POST requests
+func (r *reloader) Handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.log.Info("reload requested", "remote-addr", req.RemoteAddr)
+	r.Trigger()
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "delth: reload requested\n")
+}
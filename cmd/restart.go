@@ -0,0 +1,148 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+func parseRestartPolicy(s string) (RestartPolicy, error) {
+	switch p := RestartPolicy(s); p {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return p, nil
+	case "":
+		return RestartNever, nil
+	}
+
+	return "", fmt.Errorf("unknown restart policy %q", s)
+}
+
+// ExitPolicy is what happens when the main process exits on its
+// own and is not restarted
+type ExitPolicy string
+
+const (
+	// ExitPolicyExit terminates delth with the main process exit code
+	ExitPolicyExit ExitPolicy = "exit"
+	// ExitPolicyRestart restarts the main process whatever its exit
+	// code, until its restart limit is reached
+	ExitPolicyRestart ExitPolicy = "restart"
+	// ExitPolicyServe keeps delth running and reports the backend
+	// as exited until it is drained
+	ExitPolicyServe ExitPolicy = "serve"
+)
+
+type RestartOptions struct {
+	Policy RestartPolicy
+	// Backoff is the delay before the first restart. It is doubled
+	// for every restart that already happened within Window.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxRestarts is the maximum number of restarts allowed
+	// within Window. Zero means unlimited.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+// restartTracker decides whether an exited command must be
+// restarted and how long to wait before doing so
+type restartTracker struct {
+	opts     RestartOptions
+	restarts []time.Time
+}
+
+func newRestartTracker(opts RestartOptions) *restartTracker {
+	return &restartTracker{
+		opts: opts,
+	}
+}
+
+// shouldRestart reports whether the restart policy applies to
+// a command that exited with err
+func (r *restartTracker) shouldRestart(err error) bool {
+	switch r.opts.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		if eerr, ok := err.(*exec.ExitError); ok {
+			return eerr.ExitCode() != 0
+		}
+		return err != nil
+	}
+
+	return false
+}
+
+// next records a new restart and returns the delay to wait before
+// performing it. It returns false if the restart limit is reached.
+func (r *restartTracker) next(now time.Time) (time.Duration, bool) {
+	// forget about restarts that are out of the window
+	recent := r.restarts[:0]
+	for _, t := range r.restarts {
+		if r.opts.Window <= 0 || now.Sub(t) < r.opts.Window {
+			recent = append(recent, t)
+		}
+	}
+	r.restarts = recent
+
+	if r.opts.MaxRestarts > 0 && len(r.restarts) >= r.opts.MaxRestarts {
+		return 0, false
+	}
+
+	delay := r.opts.Backoff
+	for i := 0; i < len(r.restarts); i++ {
+		delay *= 2
+		if r.opts.MaxBackoff > 0 && delay >= r.opts.MaxBackoff {
+			delay = r.opts.MaxBackoff
+			break
+		}
+	}
+
+	r.restarts = append(r.restarts, now)
+
+	return delay, true
+}
+
+// count returns the number of restarts within the current window
+func (r *restartTracker) count() int {
+	return len(r.restarts)
+}
@@ -34,6 +34,7 @@ package cmd
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -41,17 +42,27 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/riton/delth/internal/lifecycle"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var cfgFile string
 
+// cfgFileErr records any error reading the configuration file
+// in initConfig(), to be reported by rootCmdRunE
+var cfgFileErr error
+
+// commandRun records that the command line was valid and
+// rootCmdRunE has been called
+var commandRun bool
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "delth",
@@ -72,9 +83,20 @@ to quickly create a Cobra application.`,
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	if len(os.Args) > 1 && os.Args[1] == listenFDsExecArg {
+		if err := listenFDsExec(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(exitCodeFromError(err))
+		}
+	}
+
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		if !commandRun {
+			// usage errors are reported before rootCmdRunE runs
+			err = newExitCodeError(ExitCodeConfigError, err)
+		}
+		os.Exit(exitCodeFromError(err))
 	}
 }
 
@@ -85,40 +107,132 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return newExitCodeError(ExitCodeConfigError, err)
+	})
+
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.delth.yaml)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("debug", "d", false, "Enable debug mode")
 	viper.BindPFlag("debug", rootCmd.Flags().Lookup("debug"))
+	rootCmd.Flags().Bool("reaper", false, "Reap orphaned zombie processes (always enabled when running as PID 1)")
+	viper.BindPFlag("reaper", rootCmd.Flags().Lookup("reaper"))
+	rootCmd.Flags().String("log-format", "text", "Log format, one of 'text' or 'json'")
+	viper.BindPFlag("log-format", rootCmd.Flags().Lookup("log-format"))
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		viper.AddConfigPath(home)
+		viper.SetConfigType("yaml")
+		viper.SetConfigName(".delth")
+	}
+
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 	viper.SetEnvPrefix("DELTH")
 
 	viper.AutomaticEnv() // read in environment variables that match
+
+	if err := viper.ReadInConfig(); err != nil {
+		// a missing default configuration file is not an error
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || cfgFile != "" {
+			cfgFileErr = err
+		}
+	}
 }
 
-func setupSigHandlers(ctx context.Context) context.Context {
+// shutdown escalation levels, raised by every drain signal
+const (
+	shutdownNone = iota
+	shutdownDrain
+	shutdownForce
+	shutdownKill
+)
+
+// shutdownSignals exposes the shutdown requests received by delth
+type shutdownSignals struct {
+	// drain is canceled when a drain signal is received
+	drain context.Context
+	// force is canceled when a drain signal is received again,
+	// or a force signal is received
+	force context.Context
+	// kill is canceled when a drain signal is received a third time
+	kill context.Context
+	// relayed are signals to forward to the command
+	relayed <-chan syscall.Signal
+}
+
+// setupSigHandlers dispatches received signals according to routing
+func setupSigHandlers(ctx context.Context, routing signalRouting) shutdownSignals {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	relayed := make(chan syscall.Signal, 8)
+
+	notified := append([]os.Signal{}, routing.drain...)
+	notified = append(notified, routing.force...)
+	for sig := range routing.relay {
+		notified = append(notified, sig)
+	}
+	signal.Notify(sigs, notified...)
 
 	nctx, nctxCancel := context.WithCancel(ctx)
+	forceCtx, forceCancel := context.WithCancel(context.Background())
+	killCtx, killCancel := context.WithCancel(context.Background())
 
 	go func() {
-		sig := <-sigs
-		slog.Debug("received signal", "signal", sig.String(), "component", "main")
-		nctxCancel()
+		level := shutdownNone
+
+		for sig := range sigs {
+			log := slog.With("signal", sig.String(), "component", "main")
+
+			if relaySig, ok := routing.relay[sig]; ok {
+				log.Debug("received signal to forward", "forwarded-signal", relaySig.String())
+				select {
+				case relayed <- relaySig:
+				default:
+					log.Warn("dropping signal, too many signals waiting to be forwarded")
+				}
+				continue
+			}
+
+			if slices.Contains(routing.force, sig) {
+				level = max(level, shutdownForce)
+			} else {
+				level = min(level+1, shutdownKill)
+			}
+
+			switch level {
+			case shutdownDrain:
+				log.Debug("received signal")
+				nctxCancel()
+			case shutdownForce:
+				log.Warn("received signal, skipping shutdown delay")
+				nctxCancel()
+				forceCancel()
+			case shutdownKill:
+				log.Warn("received signal again, killing processes")
+				killCancel()
+			}
+		}
 	}()
 
-	return nctx
+	return shutdownSignals{
+		drain:   nctx,
+		force:   forceCtx,
+		kill:    killCtx,
+		relayed: relayed,
+	}
 }
 
 type healthCheckProxyConfig struct {
-	Scheme     string `mapstructure:"scheme"`
-	ListenAddr string `mapstructure:"listen_addr"`
+	Scheme         string `mapstructure:"scheme"`
+	ListenAddr     string `mapstructure:"listen_addr"`
+	StartingStatus int    `mapstructure:"starting_status" validate:"gte=100,lte=599"`
+	StartingBody   string `mapstructure:"starting_body"`
 }
 
 type backendHealthCheckConfig struct {
@@ -130,23 +244,122 @@ type backendHealthCheckConfig struct {
 }
 
 type commandExecConfig struct {
-	ShutdownDelay time.Duration `mapstructure:"shutdown_delay"`
+	ShutdownDelay       time.Duration `mapstructure:"shutdown_delay"`
+	FailureDelay        time.Duration `mapstructure:"failure_delay"`
+	Drain               drainConfig   `mapstructure:"drain"`
+	StopSignal          string        `mapstructure:"stop_signal"`
+	StopTimeout         time.Duration `mapstructure:"stop_timeout"`
+	SignalProcessGroup  bool          `mapstructure:"signal_process_group"`
+	Restart             string        `mapstructure:"restart"`
+	RestartBackoff      time.Duration `mapstructure:"restart_backoff"`
+	RestartMaxBackoff   time.Duration `mapstructure:"restart_max_backoff"`
+	RestartMax          int           `mapstructure:"restart_max"`
+	RestartWindow       time.Duration `mapstructure:"restart_window"`
+	User                string        `mapstructure:"user"`
+	Group               string        `mapstructure:"group"`
+	SupplementaryGroups []string      `mapstructure:"supplementary_groups"`
+	StripDelthEnv       bool          `mapstructure:"strip_delth_env"`
+	EnvFiles            []string      `mapstructure:"env_files"`
+	ExpandFileSecrets   bool          `mapstructure:"expand_file_secrets"`
+	FileSecretsDir      string        `mapstructure:"file_secrets_dir"`
+	InjectMetadata      bool          `mapstructure:"inject_metadata"`
+	CaptureOutput       bool          `mapstructure:"capture_output"`
+	JSONLines           string        `mapstructure:"json_lines" validate:"omitempty,oneof=merge passthrough text"`
+	LogFile             logFileConfig `mapstructure:"log_file"`
+	TTY                 bool          `mapstructure:"tty"`
+	Listen              []string      `mapstructure:"listen"`
+	OnExit              string        `mapstructure:"on_exit" validate:"oneof=exit restart serve"`
+	ReloadSignal        string        `mapstructure:"reload_signal"`
+	ReloadTimeout       time.Duration `mapstructure:"reload_timeout" validate:"gt=0"`
+	ReloadReady         string        `mapstructure:"reload_ready" validate:"oneof=health notify"`
+	ReloadReadyDelay    time.Duration `mapstructure:"reload_ready_delay"`
+	ReloadEndpoint      bool          `mapstructure:"reload_endpoint"`
+	StartupTimeout      time.Duration `mapstructure:"startup_timeout" validate:"gte=0"`
+	StartupPollInterval time.Duration `mapstructure:"startup_poll_interval" validate:"gt=0"`
+}
+
+type drainConfig struct {
+	Mode                 string            `mapstructure:"mode" validate:"oneof=delay probes connections"`
+	ProbeResponses       int               `mapstructure:"probe_responses" validate:"gte=1"`
+	ProbeQuietPeriod     time.Duration     `mapstructure:"probe_quiet_period"`
+	ProbeWindow          time.Duration     `mapstructure:"probe_window"`
+	ConnectionsPorts     []int             `mapstructure:"connections_ports"`
+	ConnectionsThreshold int               `mapstructure:"connections_threshold" validate:"gte=0"`
+	Notify               drainNotifyConfig `mapstructure:"notify"`
+}
+
+type logFileConfig struct {
+	Path      string        `mapstructure:"path"`
+	MaxSizeMB int64         `mapstructure:"max_size_mb"`
+	MaxAge    time.Duration `mapstructure:"max_age"`
+	MaxFiles  int           `mapstructure:"max_files"`
+	Compress  bool          `mapstructure:"compress"`
+}
+
+type signalsConfig struct {
+	Drain   []string `mapstructure:"drain"`
+	Force   []string `mapstructure:"force"`
+	Forward []string `mapstructure:"forward"`
+	Remap   []string `mapstructure:"remap"`
+}
+
+type processConfig struct {
+	Name                string        `mapstructure:"name" validate:"required"`
+	Command             []string      `mapstructure:"command" validate:"required,min=1"`
+	Main                bool          `mapstructure:"main"`
+	LogFile             string        `mapstructure:"log_file"`
+	DependsOn           []string      `mapstructure:"depends_on"`
+	StopSignal          string        `mapstructure:"stop_signal"`
+	StopTimeout         time.Duration `mapstructure:"stop_timeout"`
+	SignalProcessGroup  bool          `mapstructure:"signal_process_group"`
+	Restart             string        `mapstructure:"restart"`
+	RestartBackoff      time.Duration `mapstructure:"restart_backoff"`
+	RestartMaxBackoff   time.Duration `mapstructure:"restart_max_backoff"`
+	RestartMax          int           `mapstructure:"restart_max"`
+	RestartWindow       time.Duration `mapstructure:"restart_window"`
+	User                string        `mapstructure:"user"`
+	Group               string        `mapstructure:"group"`
+	SupplementaryGroups []string      `mapstructure:"supplementary_groups"`
 }
 
 type config struct {
 	HealthCheckProxy   healthCheckProxyConfig   `mapstructure:"healthcheck-proxy"`
 	BackendHealthCheck backendHealthCheckConfig `mapstructure:"backend-healthcheck"`
 	CommandExec        commandExecConfig        `mapstructure:"cmd-exec"`
+	Signals            signalsConfig            `mapstructure:"signals"`
+	Processes          []processConfig          `mapstructure:"processes" validate:"dive"`
+	Hooks              hooksConfig              `mapstructure:"hooks"`
+	Templates          []templateConfig         `mapstructure:"templates" validate:"dive"`
+	Shutdown           shutdownConfig           `mapstructure:"shutdown"`
 }
 
 func rootCmdRunE(cmd *cobra.Command, args []string) error {
+	commandRun = true
+
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	defer rootCancel()
 
+	logLevel := slog.LevelInfo
+	if viper.GetBool("debug") {
+		logLevel = slog.LevelDebug
+	}
+
+	switch logFormat := viper.GetString("log-format"); logFormat {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: logLevel,
+		})))
+	case "text", "":
+		slog.SetLogLoggerLevel(logLevel)
+	default:
+		return newExitCodeError(ExitCodeConfigError, fmt.Errorf("unknown log format %q", logFormat))
+	}
+
 	log := slog.With("component", "main")
 
-	if viper.GetBool("debug") {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+	if cfgFileErr != nil {
+		log.Error("reading configuration file", "error", cfgFileErr)
+		return newExitCodeError(ExitCodeConfigError, cfgFileErr)
 	}
 
 	// our default configuration
@@ -156,11 +369,47 @@ func rootCmdRunE(cmd *cobra.Command, args []string) error {
 			HTTPTimeout: 30 * time.Second,
 		},
 		HealthCheckProxy: healthCheckProxyConfig{
-			ListenAddr: ":8069",
-			Scheme:     "http",
+			ListenAddr:     ":8069",
+			Scheme:         "http",
+			StartingStatus: http.StatusServiceUnavailable,
+			StartingBody:   "delth: service is starting\n",
 		},
 		CommandExec: commandExecConfig{
-			ShutdownDelay: 30 * time.Second,
+			ShutdownDelay:     30 * time.Second,
+			StopSignal:        "SIGTERM",
+			StopTimeout:       10 * time.Second,
+			Restart:           string(RestartNever),
+			RestartBackoff:    time.Second,
+			RestartMaxBackoff: 30 * time.Second,
+			RestartMax:        5,
+			RestartWindow:     5 * time.Minute,
+			FileSecretsDir:    "/run/secrets",
+			JSONLines:         JSONLinesMerge,
+			LogFile: logFileConfig{
+				MaxSizeMB: 100,
+				MaxFiles:  5,
+			},
+			Drain: drainConfig{
+				Mode:             DrainModeDelay,
+				ProbeResponses:   2,
+				ProbeQuietPeriod: 15 * time.Second,
+				ProbeWindow:      time.Minute,
+				Notify: drainNotifyConfig{
+					Timeout: 10 * time.Second,
+				},
+			},
+			OnExit:              string(ExitPolicyExit),
+			ReloadSignal:        "SIGHUP",
+			ReloadTimeout:       time.Minute,
+			ReloadReady:         ReloadReadyHealth,
+			ReloadReadyDelay:    5 * time.Second,
+			StartupPollInterval: time.Second,
+		},
+		Hooks: hooksConfig{
+			Timeout: 30 * time.Second,
+		},
+		Shutdown: shutdownConfig{
+			ServerTimeout: 3 * time.Second,
 		},
 	}
 
@@ -169,23 +418,94 @@ func rootCmdRunE(cmd *cobra.Command, args []string) error {
 	// environment variables
 	if err := viper.Unmarshal(&cfg); err != nil {
 		log.Error("unmarshaling configuration")
-		return err
+		return newExitCodeError(ExitCodeConfigError, err)
 	}
 
 	cfgValidator := validator.New()
 	if err := cfgValidator.Struct(&cfg); err != nil {
 		log.Error("missing required configuration")
-		return err
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	cmdEnv, err := buildCmdEnv(cfg)
+	if err != nil {
+		log.Error("building command environment")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	procSpecs, err := processSpecs(cfg, args, cmdEnv)
+	if err != nil {
+		log.Error("invalid processes configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	cfgTemplates, err := newConfigTemplates(cfg.Templates, cmdEnv, procSpecs)
+	if err != nil {
+		log.Error("invalid templates configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	sigRouting, err := parseSignalRouting(cfg.Signals)
+	if err != nil {
+		log.Error("invalid signals configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	if err := validateHooks(cfg.Hooks); err != nil {
+		log.Error("invalid hooks configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	drainNotify, err := newDrainNotifier(cfg.CommandExec.Drain.Notify)
+	if err != nil {
+		log.Error("invalid drain notification configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	shutdownPhases, err := parseShutdownPhases(cfg.Shutdown.Phases)
+	if err != nil {
+		log.Error("invalid shutdown configuration")
+		return newExitCodeError(ExitCodeConfigError, err)
+	}
+
+	var reloadSig syscall.Signal
+	if len(cfg.CommandExec.Listen) > 0 {
+		reloadSig, err = parseReloadSignal(cfg.CommandExec.ReloadSignal, sigRouting)
+		if err != nil {
+			log.Error("invalid reload signal")
+			return newExitCodeError(ExitCodeConfigError, err)
+		}
 	}
 
 	log.Debug("delth configuration", "config", cfg)
 
-	sigCtx := setupSigHandlers(rootCtx)
+	if viper.GetBool("reaper") || os.Getpid() == 1 {
+		// the reaper must outlive rootCtx, which is canceled
+		// as soon as the command fails
+		reaperCtx, reaperCancel := context.WithCancel(context.Background())
+		defer reaperCancel()
+
+		if err := procReaper.Run(reaperCtx); err != nil {
+			log.Error("starting zombie reaper", "error", err)
+			return newExitCodeError(ExitCodeInternalError, err)
+		}
+	}
+
+	shutdownSigs := setupSigHandlers(rootCtx, sigRouting)
+	sigCtx := shutdownSigs.drain
+
+	// the health check proxy keeps serving until the processes
+	// are stopping, a shutdown timeline may keep delth healthy
+	// for a while after the drain signal
+	serveCtx, serveCancel := context.WithCancel(context.Background())
+	defer serveCancel()
 
-	proxy := NewHealthCheckProxy(sigCtx, HealthCheckProxyOptions{
+	proxy := NewHealthCheckProxy(serveCtx, HealthCheckProxyOptions{
 		RealHealthCheckPath:   cfg.BackendHealthCheck.Path,
 		RealHealthCheckPort:   cfg.BackendHealthCheck.Port,
 		RealHealthCheckScheme: cfg.BackendHealthCheck.Scheme,
+		StartingStatus:        cfg.HealthCheckProxy.StartingStatus,
+		StartingBody:          cfg.HealthCheckProxy.StartingBody,
 	})
 
 	hClient := &http.Client{
@@ -202,51 +522,298 @@ func rootCmdRunE(cmd *cobra.Command, args []string) error {
 
 	proxy.SetHTTPClient(hClient)
 
+	var probes *probeTracker
+	if cfg.CommandExec.Drain.Mode == DrainModeProbes {
+		probes = newProbeTracker(ProbeDrainOptions{
+			Responses:   cfg.CommandExec.Drain.ProbeResponses,
+			QuietPeriod: cfg.CommandExec.Drain.ProbeQuietPeriod,
+			Window:      cfg.CommandExec.Drain.ProbeWindow,
+		})
+		proxy.SetProbeTracker(probes)
+	}
+
+	lc := lifecycle.New()
+	lc.Subscribe(func(t lifecycle.Transition) {
+		log.Info("lifecycle state changed", "from", t.From.String(), "to", t.To.String(), "reason", t.Reason)
+	})
+	lc.Subscribe(proxy.SetLifecycleState)
+
+	transition := func(to lifecycle.State, reason string) {
+		if err := lc.Transition(to, reason); err != nil {
+			log.Debug("skipping lifecycle transition", "error", err)
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/delth/health", http.HandlerFunc(proxy.HealthHandler))
 
 	srv := http.Server{
 		Addr: cfg.HealthCheckProxy.ListenAddr,
 		BaseContext: func(net.Listener) context.Context {
-			return sigCtx
+			return serveCtx
 		},
 		Handler: mux,
 	}
 
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Error("binding health check proxy listener", "listen-addr", srv.Addr, "error", err)
+		return newExitCodeError(ExitCodeListenError, err)
+	}
+
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
 			slog.Error("serving HTTP requests", "component", "http-server", "error", err)
 		}
 	}()
 
-	var globalExitErr error = nil
+	if len(cfg.CommandExec.Listen) > 0 {
+		// the sockets are owned by delth so that they outlive
+		// any generation of the main process
+		listenFiles, err := openListenFiles(cfg.CommandExec.Listen)
+		if err != nil {
+			log.Error("binding main process listeners", "listen", cfg.CommandExec.Listen, "error", err)
+			return newExitCodeError(ExitCodeListenError, err)
+		}
+
+		for i := range procSpecs {
+			if procSpecs[i].main {
+				procSpecs[i].opts.ListenFiles = listenFiles
+			}
+		}
+	}
 
-	cmdWrapper := NewCmdExecutor(sigCtx, args[0], args[1:]...)
-	cmdWrapper.SetOnCmdFailureCb(func(err *exec.ExitError) {
-		log.Debug("detected command failure, canceling root context")
+	// globalExitErr is set from the executor and startup goroutines
+	var globalExitErr exitErrorHolder
+
+	for _, t := range cfgTemplates {
+		if _, err := t.Render(); err != nil {
+			log.Error("rendering configuration template", "error", err)
+			return newExitCodeError(ExitCodeConfigError, err)
+		}
+	}
+
+	hooks := NewHookRunner(cfg.Hooks, cmdEnv)
+
+	if err := hooks.Run(sigCtx, hookPreStart, nil); err != nil {
+		return newExitCodeError(ExitCodeHookError, err)
+	}
+
+	procSupervisor := NewSupervisor(sigCtx, procSpecs)
+
+	cmdWrapper := procSupervisor.Main()
+	cmdWrapper.SetOnCmdStartCb(func() {
+		proxy.SetBackendExited(false)
+		proxy.SetBackendDown(false)
+	})
+	cmdWrapper.SetOnCmdExitCb(func(err error) {
+		proxy.SetBackendDown(true)
+	})
+	cmdWrapper.SetOnCmdEndCb(func(err error) {
+		exitPolicy := ExitPolicy(cfg.CommandExec.OnExit)
+
+		if exitPolicy == ExitPolicyServe {
+			log.Warn("command has ended, reporting backend as exited until drained", "exit-policy", exitPolicy)
+			proxy.SetBackendExited(true)
+			return
+		}
+
+		log.Info("command has ended, terminating", "exit-policy", exitPolicy)
+		if err != nil {
+			globalExitErr.Set(fmt.Errorf("command has failed: %w", err))
+			transition(lifecycle.Failed, "main process has failed")
+		} else {
+			transition(lifecycle.Draining, "main process has exited")
+		}
 		rootCancel()
-		globalExitErr = fmt.Errorf("command has failed: %w", err)
 	})
 
-	if err := cmdWrapper.Start(); err != nil {
-		return fmt.Errorf("starting command: %w", err)
+	if err := drainNotify.Reset(); err != nil {
+		log.Error("removing drain notification file", "error", err)
+		return newExitCodeError(ExitCodeInternalError, err)
 	}
 
+	if len(shutdownPhases) == 0 {
+		lc.Subscribe(func(t lifecycle.Transition) {
+			// there is nothing to notify once the main process has exited
+			if main := procSupervisor.Main(); t.To == lifecycle.Draining && main.Running() {
+				go drainNotify.Notify(context.Background(), main)
+			}
+		})
+	}
+
+	if err := procSupervisor.Start(); err != nil {
+		return newExitCodeError(ExitCodeStartError, fmt.Errorf("starting command: %w", err))
+	}
+
+	startedAt := time.Now()
+
+	if err := hooks.Run(sigCtx, hookPostStart, nil); err != nil {
+		log.Debug("post-start hook failed, canceling root context")
+		globalExitErr.Set(newExitCodeError(ExitCodeHookError, err))
+		transition(lifecycle.Failed, "post_start hook has failed")
+		rootCancel()
+	} else {
+		gate := newStartupGate(proxy, cfg.CommandExec.StartupPollInterval, cfg.CommandExec.StartupTimeout)
+
+		go func() {
+			err := gate.Wait(sigCtx, startedAt)
+			switch {
+			case err == nil:
+				transition(lifecycle.Ready, "backend is healthy")
+			case errors.Is(err, errStartupTimeout):
+				log.Error("backend has not been healthy in time, terminating", "startup-timeout", cfg.CommandExec.StartupTimeout)
+				globalExitErr.Set(newExitCodeError(ExitCodeStartupTimeout, err))
+				transition(lifecycle.Failed, "startup timeout expired")
+				rootCancel()
+			}
+		}()
+	}
+
+	for _, t := range cfgTemplates {
+		if t.cfg.Watch {
+			go t.Watch(sigCtx, func(process string, sig syscall.Signal) error {
+				e, err := procSupervisor.Process(process)
+				if err != nil {
+					return err
+				}
+				return e.Signal(sig)
+			})
+		}
+	}
+
+	if len(cfg.CommandExec.Listen) > 0 {
+		procReloader := newReloader(procSupervisor, proxy, ReloadOptions{
+			Timeout:    cfg.CommandExec.ReloadTimeout,
+			Ready:      cfg.CommandExec.ReloadReady,
+			ReadyDelay: cfg.CommandExec.ReloadReadyDelay,
+		})
+		go procReloader.Run(sigCtx)
+
+		reloadSigs := make(chan os.Signal, 1)
+		signal.Notify(reloadSigs, reloadSig)
+
+		go func() {
+			for range reloadSigs {
+				log.Info("received reload signal", "signal", reloadSig.String())
+				procReloader.Trigger()
+			}
+		}()
+
+		if cfg.CommandExec.ReloadEndpoint {
+			mux.Handle("/delth/reload", http.HandlerFunc(procReloader.Handler))
+		}
+	}
+
+	if slices.ContainsFunc(procSpecs, func(p processSpec) bool { return p.logFileOpts != nil }) {
+		reopenSigs := make(chan os.Signal, 1)
+		signal.Notify(reopenSigs, syscall.SIGUSR1)
+
+		go func() {
+			for range reopenSigs {
+				log.Debug("received SIGUSR1, reopening log files")
+				procSupervisor.ReopenLogFiles()
+			}
+		}()
+	}
+
+	go func() {
+		<-shutdownSigs.kill.Done()
+		procSupervisor.Kill()
+	}()
+
+	go func() {
+		for sig := range shutdownSigs.relayed {
+			if err := procSupervisor.Main().Signal(sig); err != nil {
+				log.Error("forwarding signal to command", "signal", sig.String(), "error", err)
+			}
+		}
+	}()
+
 	<-sigCtx.Done()
 
-	log.Debug("initiating proxy shutdown")
+	drain := &drainer{
+		cfg:          cfg.CommandExec.Drain,
+		probes:       probes,
+		fallbackPort: cfg.BackendHealthCheck.Port,
+		failureDelay: cfg.CommandExec.FailureDelay,
+		failed:       func() bool { return lc.State() == lifecycle.Failed },
+		supervisor:   procSupervisor,
+		force:        shutdownSigs.force,
+		log:          log,
+	}
+
+	stopping := false
+	beginStop := func(reason string) {
+		if stopping {
+			return
+		}
+		stopping = true
 
-	proxy.InitiateShutdown()
+		transition(lifecycle.Stopping, reason)
+		serveCancel()
 
-	log.Debug("delaying process shutdown")
+		if err := hooks.Run(context.Background(), hookPreStop, nil); err != nil {
+			globalExitErr.SetIfNone(newExitCodeError(ExitCodeHookError, err))
+		}
+	}
 
-	time.Sleep(cfg.CommandExec.ShutdownDelay)
+	if len(shutdownPhases) > 0 {
+		timeline := &shutdownTimeline{
+			phases:        shutdownPhases,
+			supervisor:    procSupervisor,
+			drainer:       drain,
+			notifier:      drainNotify,
+			hooks:         hooks,
+			shutdownDelay: cfg.CommandExec.ShutdownDelay,
+			force:         shutdownSigs.force,
+			markUnhealthy: func(reason string) {
+				if !lc.State().ShuttingDown() {
+					transition(lifecycle.Draining, reason)
+				}
+			},
+			stopping: beginStop,
+			log:      slog.Default().With("component", "shutdown"),
+		}
+
+		if err := timeline.Run(); err != nil {
+			globalExitErr.SetIfNone(newExitCodeError(ExitCodeHookError, err))
+		}
+
+		beginStop("shutdown phases are complete")
+	} else {
+		if !lc.State().ShuttingDown() {
+			transition(lifecycle.Draining, "drain signal received")
+		}
 
-	log.Debug("delay expired, killing process")
+		beginStop(drain.Wait(cfg.CommandExec.ShutdownDelay))
+	}
+
+	if err := procSupervisor.Stop(); err != nil {
+		var eerr *exec.ExitError
+		if errors.Is(err, errCmdKilled) {
+			log.Error("stopping command", "error", err)
+			globalExitErr.Set(err)
+		} else if errors.As(err, &eerr) && globalExitErr.Get() == nil {
+			log.Debug("command exited", "exit-code", cmdExitCode(eerr))
+			globalExitErr.SetIfNone(fmt.Errorf("command exited: %w", eerr))
+		} else {
+			log.Debug("stopping command", "error", err)
+		}
+	}
+
+	exitCode := 0
+	if err := globalExitErr.Get(); err != nil {
+		exitCode = exitCodeFromError(err)
+	}
+
+	if err := hooks.Run(context.Background(), hookPostStop, []string{fmt.Sprintf("DELTH_EXIT_CODE=%d", exitCode)}); err != nil {
+		globalExitErr.SetIfNone(newExitCodeError(ExitCodeHookError, err))
+	}
 
-	cmdWrapper.Stop()
+	transition(lifecycle.Stopped, "processes are stopped")
 
-	shutdownCtx, shutdownCancelFn := context.WithTimeout(context.Background(), 3*time.Second)
+	shutdownCtx, shutdownCancelFn := context.WithTimeout(context.Background(), cfg.Shutdown.ServerTimeout)
 	defer shutdownCancelFn()
 
 	log.Debug("shutting down HTTP server")
@@ -257,5 +824,5 @@ func rootCmdRunE(cmd *cobra.Command, args []string) error {
 
 	log.Debug("HTTP server is stopped")
 
-	return globalExitErr
+	return globalExitErr.Get()
 }
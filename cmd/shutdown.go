@@ -0,0 +1,289 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"syscall"
+	"time"
+)
+
+// Shutdown phase actions
+const (
+	// PhaseMarkUnhealthy makes delth report itself as draining
+	PhaseMarkUnhealthy = "mark_unhealthy"
+	// PhaseNotify notifies the application of the drain,
+	// see 'cmd-exec.drain.notify'
+	PhaseNotify = "notify"
+	// PhaseWait waits for the phase duration
+	PhaseWait = "wait"
+	// PhaseDrain waits for the drain to complete, as configured
+	// by 'cmd-exec.drain', for at most the phase duration
+	PhaseDrain = "drain"
+	// PhaseSignal sends a signal to the main process
+	PhaseSignal = "signal"
+	// PhaseWaitExit waits for the main process to exit
+	PhaseWaitExit = "wait_exit"
+	// PhaseKill sends SIGKILL to the main process
+	PhaseKill = "kill"
+	// PhaseHook runs a hook
+	PhaseHook = "hook"
+)
+
+type shutdownConfig struct {
+	// Phases replace the default shutdown sequence when set
+	Phases []shutdownPhaseConfig `mapstructure:"phases" validate:"dive"`
+	// ServerTimeout bounds the shutdown of the health check proxy
+	ServerTimeout time.Duration `mapstructure:"server_timeout" validate:"gt=0"`
+}
+
+type shutdownPhaseConfig struct {
+	Name   string `mapstructure:"name"`
+	Action string `mapstructure:"action" validate:"oneof=mark_unhealthy notify wait drain signal wait_exit kill hook"`
+	// Duration is how long mark_unhealthy, notify and wait phases
+	// last after their action, and the maximum time drain,
+	// signal, wait_exit and kill phases wait for their completion
+	// condition. Zero means no wait for signal phases and no
+	// limit for wait_exit and kill phases. Phases not stopping the
+	// main process end when it exits and, once delth has failed,
+	// share the failure delay.
+	Duration time.Duration `mapstructure:"duration" validate:"gte=0"`
+	Signal   string        `mapstructure:"signal"`
+	Hook     hookConfig    `mapstructure:"hook"`
+}
+
+type shutdownPhase struct {
+	shutdownPhaseConfig
+	sig syscall.Signal
+}
+
+// parseShutdownPhases checks phases that can not be validated with
+// struct tags and names the anonymous ones
+func parseShutdownPhases(cfgs []shutdownPhaseConfig) ([]shutdownPhase, error) {
+	phases := make([]shutdownPhase, 0, len(cfgs))
+
+	for i, c := range cfgs {
+		p := shutdownPhase{shutdownPhaseConfig: c}
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("%s#%d", c.Action, i)
+		}
+
+		switch c.Action {
+		case PhaseWait:
+			if c.Duration == 0 {
+				return nil, fmt.Errorf("shutdown phase %q: missing duration", p.Name)
+			}
+		case PhaseSignal:
+			if c.Signal == "" {
+				return nil, fmt.Errorf("shutdown phase %q: missing signal", p.Name)
+			}
+
+			sig, err := parseSignal(c.Signal)
+			if err != nil {
+				return nil, fmt.Errorf("shutdown phase %q: %w", p.Name, err)
+			}
+			p.sig = sig
+		case PhaseHook:
+			if err := validateHook(c.Hook); err != nil {
+				return nil, fmt.Errorf("shutdown phase %q: %w", p.Name, err)
+			}
+
+			if p.Hook.Timeout <= 0 {
+				p.Hook.Timeout = c.Duration
+			}
+		}
+
+		phases = append(phases, p)
+	}
+
+	return phases, nil
+}
+
+// shutdownTimeline runs a declared sequence of shutdown phases
+type shutdownTimeline struct {
+	phases        []shutdownPhase
+	supervisor    *supervisor
+	drainer       *drainer
+	notifier      *drainNotifier
+	hooks         *hookRunner
+	shutdownDelay time.Duration
+	force         context.Context
+	// markUnhealthy and stopping apply the matching
+	// lifecycle transitions
+	markUnhealthy func(reason string)
+	stopping      func(reason string)
+	log           *slog.Logger
+
+	// failedAt is when the timeline has noticed delth has failed
+	failedAt time.Time
+}
+
+// Run runs every phase in order, whatever the outcome of the
+// previous ones, and returns the error of the first failed hook
+func (t *shutdownTimeline) Run() error {
+	var hookErr error
+
+	start := time.Now()
+
+	for i, p := range t.phases {
+		log := t.log.With("phase", p.Name, "action", p.Action)
+
+		log.Info("shutdown phase started", "position", i+1, "elapsed", time.Since(start))
+		phaseStart := time.Now()
+
+		outcome, err := t.run(p)
+		if err != nil && hookErr == nil {
+			hookErr = err
+		}
+
+		log.Info("shutdown phase ended", "outcome", outcome, "duration", time.Since(phaseStart), "elapsed", time.Since(start))
+	}
+
+	t.log.Info("shutdown phases are complete", "duration", time.Since(start))
+
+	return hookErr
+}
+
+// run runs a single phase and returns how it has ended
+func (t *shutdownTimeline) run(p shutdownPhase) (string, error) {
+	main := t.supervisor.Main()
+	reason := fmt.Sprintf("shutdown phase %q", p.Name)
+
+	switch p.Action {
+	case PhaseMarkUnhealthy:
+		t.markUnhealthy(reason)
+		return t.hold(p.Duration), nil
+	case PhaseNotify:
+		if !main.Running() {
+			return "main process is not running", nil
+		}
+		t.notifier.Notify(context.Background(), main)
+		return t.hold(p.Duration), nil
+	case PhaseWait:
+		return t.hold(p.Duration), nil
+	case PhaseDrain:
+		delay := p.Duration
+		if delay == 0 {
+			delay = t.shutdownDelay
+		}
+		if _, failed := t.failureBudget(); failed {
+			return t.hold(delay), nil
+		}
+		return t.drainer.Wait(delay), nil
+	case PhaseSignal:
+		t.stopping(reason)
+		if err := main.Signal(p.sig); err != nil {
+			return fmt.Sprintf("sending %s: %s", p.Signal, err), nil
+		}
+		if p.Duration == 0 {
+			return "signal sent", nil
+		}
+		return t.wait(p.Duration, main.Done()), nil
+	case PhaseWaitExit:
+		t.stopping(reason)
+		return t.wait(p.Duration, main.Done()), nil
+	case PhaseKill:
+		t.stopping(reason)
+		if err := main.Kill(); err != nil {
+			return fmt.Sprintf("killing: %s", err), nil
+		}
+		return t.wait(p.Duration, main.Done()), nil
+	case PhaseHook:
+		if err := t.hooks.RunHook(context.Background(), hookShutdown, p.Name, p.Hook, nil); err != nil {
+			return "hook failed", err
+		}
+		return "hook succeeded", nil
+	}
+
+	return "unknown action", nil
+}
+
+// hold waits for the duration of a phase not stopping the main
+// process, or until the main process exits
+func (t *shutdownTimeline) hold(delay time.Duration) string {
+	if delay == 0 {
+		return "done"
+	}
+
+	if remaining, failed := t.failureBudget(); failed {
+		if remaining < delay {
+			delay = remaining
+		}
+		if delay <= 0 {
+			return "skipped, delth has failed"
+		}
+		if outcome := t.wait(delay, nil); outcome != "duration elapsed" {
+			return outcome
+		}
+		return "failure delay expired"
+	}
+
+	return t.wait(delay, t.supervisor.Main().Done())
+}
+
+// failureBudget reports whether delth has failed and, if so, what
+// is left of the failure delay. There is nothing to drain from a
+// failed process, the phases not stopping it share the failure
+// delay instead of waiting for their own duration.
+func (t *shutdownTimeline) failureBudget() (time.Duration, bool) {
+	if !t.drainer.failed() {
+		return 0, false
+	}
+
+	if t.failedAt.IsZero() {
+		t.failedAt = time.Now()
+	}
+
+	return t.drainer.failureDelay - time.Since(t.failedAt), true
+}
+
+// wait waits for delay, or without limit if delay is zero,
+// unless done is closed or the stop is forced first
+func (t *shutdownTimeline) wait(delay time.Duration, done <-chan struct{}) string {
+	var expired <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-expired:
+		return "duration elapsed"
+	case <-t.force.Done():
+		return "skipped"
+	case <-done:
+		return "main process has exited"
+	}
+}
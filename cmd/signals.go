@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGABRT":   syscall.SIGABRT,
+	"SIGALRM":   syscall.SIGALRM,
+	"SIGCHLD":   syscall.SIGCHLD,
+	"SIGCONT":   syscall.SIGCONT,
+	"SIGHUP":    syscall.SIGHUP,
+	"SIGINT":    syscall.SIGINT,
+	"SIGIO":     syscall.SIGIO,
+	"SIGKILL":   syscall.SIGKILL,
+	"SIGPIPE":   syscall.SIGPIPE,
+	"SIGPROF":   syscall.SIGPROF,
+	"SIGQUIT":   syscall.SIGQUIT,
+	"SIGSTOP":   syscall.SIGSTOP,
+	"SIGSYS":    syscall.SIGSYS,
+	"SIGTERM":   syscall.SIGTERM,
+	"SIGTRAP":   syscall.SIGTRAP,
+	"SIGTSTP":   syscall.SIGTSTP,
+	"SIGTTIN":   syscall.SIGTTIN,
+	"SIGTTOU":   syscall.SIGTTOU,
+	"SIGURG":    syscall.SIGURG,
+	"SIGUSR1":   syscall.SIGUSR1,
+	"SIGUSR2":   syscall.SIGUSR2,
+	"SIGVTALRM": syscall.SIGVTALRM,
+	"SIGWINCH":  syscall.SIGWINCH,
+	"SIGXCPU":   syscall.SIGXCPU,
+	"SIGXFSZ":   syscall.SIGXFSZ,
+}
+
+// parseSignal converts a signal specification such as "SIGQUIT", "quit"
+// or "3" into a syscall.Signal
+func parseSignal(s string) (syscall.Signal, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	if !strings.HasPrefix(s, "SIG") {
+		s = "SIG" + s
+	}
+
+	sig, ok := signalsByName[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+
+	return sig, nil
+}
+
+var defaultDrainSignals = []string{"SIGINT", "SIGTERM"}
+
+// signalRouting describes what delth does with the signals it receives
+type signalRouting struct {
+	// drain signals initiate delth shutdown. Receiving one again
+	// forces the stop and a third time kills the processes.
+	drain []os.Signal
+	// force signals skip the remaining shutdown delay
+	force []os.Signal
+	// relay maps a received signal to the signal that
+	// is forwarded to the command
+	relay map[os.Signal]syscall.Signal
+}
+
+func parseSignalList(names []string) ([]syscall.Signal, error) {
+	sigs := make([]syscall.Signal, 0, len(names))
+	for _, name := range names {
+		sig, err := parseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+
+	return sigs, nil
+}
+
+func parseSignalRouting(cfg signalsConfig) (signalRouting, error) {
+	routing := signalRouting{
+		relay: make(map[os.Signal]syscall.Signal),
+	}
+
+	// defaults are not set in the configuration struct since
+	// slices are merged rather than replaced when unmarshaling
+	drainNames := cfg.Drain
+	if len(drainNames) == 0 {
+		drainNames = defaultDrainSignals
+	}
+
+	drain, err := parseSignalList(drainNames)
+	if err != nil {
+		return routing, fmt.Errorf("parsing drain signals: %w", err)
+	}
+
+	forward, err := parseSignalList(cfg.Forward)
+	if err != nil {
+		return routing, fmt.Errorf("parsing forwarded signals: %w", err)
+	}
+
+	for _, sig := range forward {
+		routing.relay[sig] = sig
+	}
+
+	for _, rule := range cfg.Remap {
+		from, to, found := strings.Cut(rule, ":")
+		if !found {
+			return routing, fmt.Errorf("invalid signal remapping %q, expecting FROM:TO", rule)
+		}
+
+		fromSig, err := parseSignal(from)
+		if err != nil {
+			return routing, fmt.Errorf("parsing signal remapping %q: %w", rule, err)
+		}
+
+		toSig, err := parseSignal(to)
+		if err != nil {
+			return routing, fmt.Errorf("parsing signal remapping %q: %w", rule, err)
+		}
+
+		routing.relay[fromSig] = toSig
+	}
+
+	for sig := range routing.relay {
+		switch sig {
+		case syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGCHLD:
+			return routing, fmt.Errorf("signal %s cannot be forwarded", sig)
+		}
+	}
+
+	for _, sig := range drain {
+		if _, ok := routing.relay[sig]; ok {
+			if len(cfg.Drain) == 0 {
+				// forwarding a default drain signal replaces its default handling
+				continue
+			}
+			return routing, fmt.Errorf("signal %s cannot be both a drain and a forwarded signal", sig)
+		}
+		routing.drain = append(routing.drain, sig)
+	}
+
+	force, err := parseSignalList(cfg.Force)
+	if err != nil {
+		return routing, fmt.Errorf("parsing force signals: %w", err)
+	}
+
+	for _, sig := range force {
+		if _, ok := routing.relay[sig]; ok {
+			return routing, fmt.Errorf("signal %s cannot be both a force and a forwarded signal", sig)
+		}
+		if slices.Contains(routing.drain, os.Signal(sig)) {
+			return routing, fmt.Errorf("signal %s cannot be both a force and a drain signal", sig)
+		}
+		routing.force = append(routing.force, sig)
+	}
+
+	return routing, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errStartupTimeout is returned when the backend has not been
+// healthy within the startup timeout
+var errStartupTimeout = errors.New("backend has not been healthy within the startup timeout")
+
+// startupGate holds delth in the starting state until the
+// backend health check has succeeded once
+type startupGate struct {
+	proxy    *healthCheckProxy
+	interval time.Duration
+	timeout  time.Duration
+	log      *slog.Logger
+}
+
+func newStartupGate(proxy *healthCheckProxy, interval, timeout time.Duration) *startupGate {
+	return &startupGate{
+		proxy:    proxy,
+		interval: interval,
+		timeout:  timeout,
+		log:      slog.Default().With("component", "startup"),
+	}
+}
+
+// Wait polls the backend health check until it succeeds. It fails
+// with errStartupTimeout once the timeout, unless zero, has elapsed
+// since startedAt, or with the error of ctx if it is done first.
+func (g *startupGate) Wait(ctx context.Context, startedAt time.Time) error {
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadlineCause(ctx, startedAt.Add(g.timeout), errStartupTimeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		err := g.proxy.CheckBackend(ctx)
+		if err == nil {
+			g.log.Info("backend is healthy", "startup-duration", time.Since(startedAt))
+			return nil
+		}
+
+		g.log.Debug("backend is not healthy yet", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
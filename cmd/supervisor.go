@@ -0,0 +1,499 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// processSpec is a fully resolved command to supervise
+type processSpec struct {
+	name        string
+	main        bool
+	dependsOn   []string
+	command     []string
+	logFileOpts *LogFileOptions
+	opts        CmdExecutorOptions
+}
+
+// executorOptions resolves the executor options of a process,
+// falling back to the 'cmd-exec' settings for anything not
+// specified at the process level
+func executorOptions(defaults commandExecConfig, p processConfig, env []string) (CmdExecutorOptions, error) {
+	opts := CmdExecutorOptions{
+		Name:               p.Name,
+		Env:                env,
+		CaptureOutput:      defaults.CaptureOutput,
+		JSONLines:          defaults.JSONLines,
+		TTY:                defaults.TTY && p.Main, // only the main process gets delth stdin
+		StopTimeout:        defaults.StopTimeout,
+		SignalProcessGroup: defaults.SignalProcessGroup || p.SignalProcessGroup,
+		Restart: RestartOptions{
+			Backoff:     defaults.RestartBackoff,
+			MaxBackoff:  defaults.RestartMaxBackoff,
+			MaxRestarts: defaults.RestartMax,
+			Window:      defaults.RestartWindow,
+		},
+	}
+
+	stopSignal := defaults.StopSignal
+	if p.StopSignal != "" {
+		stopSignal = p.StopSignal
+	}
+
+	sig, err := parseSignal(stopSignal)
+	if err != nil {
+		return opts, fmt.Errorf("parsing stop signal: %w", err)
+	}
+	opts.StopSignal = sig
+
+	restart := defaults.Restart
+	if p.Restart != "" {
+		restart = p.Restart
+	}
+
+	policy, err := parseRestartPolicy(restart)
+	if err != nil {
+		return opts, err
+	}
+	opts.Restart.Policy = policy
+
+	if p.Main && ExitPolicy(defaults.OnExit) == ExitPolicyRestart {
+		opts.Restart.Policy = RestartAlways
+	}
+
+	userSpec, groupSpec, groups := defaults.User, defaults.Group, defaults.SupplementaryGroups
+	if p.User != "" || p.Group != "" || len(p.SupplementaryGroups) > 0 {
+		userSpec, groupSpec, groups = p.User, p.Group, p.SupplementaryGroups
+	}
+
+	cred, err := resolveCredential(userSpec, groupSpec, groups)
+	if err != nil {
+		return opts, fmt.Errorf("resolving user and group: %w", err)
+	}
+	opts.Credential = cred
+
+	if p.StopTimeout > 0 {
+		opts.StopTimeout = p.StopTimeout
+	}
+
+	if p.RestartBackoff > 0 {
+		opts.Restart.Backoff = p.RestartBackoff
+	}
+
+	if p.RestartMaxBackoff > 0 {
+		opts.Restart.MaxBackoff = p.RestartMaxBackoff
+	}
+
+	if p.RestartMax > 0 {
+		opts.Restart.MaxRestarts = p.RestartMax
+	}
+
+	if p.RestartWindow > 0 {
+		opts.Restart.Window = p.RestartWindow
+	}
+
+	return opts, nil
+}
+
+// logFileOptions returns the log file options of a process, or nil
+// if its output is not written to a file. Any '{process}' in the
+// default log file path is replaced by the process name.
+func logFileOptions(defaults logFileConfig, p processConfig) *LogFileOptions {
+	path := p.LogFile
+	if path == "" {
+		path = strings.ReplaceAll(defaults.Path, "{process}", p.Name)
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	return &LogFileOptions{
+		Path:     path,
+		MaxSize:  defaults.MaxSizeMB * 1024 * 1024,
+		MaxAge:   defaults.MaxAge,
+		MaxFiles: defaults.MaxFiles,
+		Compress: defaults.Compress,
+	}
+}
+
+// processSpecs returns the processes to supervise, sorted in start
+// order. The command given on the command line, if any, is the
+// main process. Every process is run with env as environment.
+func processSpecs(cfg config, args []string, env []string) ([]processSpec, error) {
+	processes := cfg.Processes
+
+	if len(args) > 0 {
+		processes = append([]processConfig{{
+			Name:    "main",
+			Command: args,
+			Main:    true,
+		}}, processes...)
+	}
+
+	if len(processes) == 0 {
+		return nil, errors.New("missing command to execute")
+	}
+
+	specs := make(map[string]processSpec, len(processes))
+	names := make([]string, 0, len(processes))
+	mainName := ""
+
+	for _, p := range processes {
+		if _, exists := specs[p.Name]; exists {
+			return nil, fmt.Errorf("duplicate process name %q", p.Name)
+		}
+
+		if p.Main {
+			if mainName != "" {
+				return nil, fmt.Errorf("processes %q and %q are both marked as main", mainName, p.Name)
+			}
+			mainName = p.Name
+		}
+
+		opts, err := executorOptions(cfg.CommandExec, p, env)
+		if err != nil {
+			return nil, fmt.Errorf("process %q: %w", p.Name, err)
+		}
+
+		specs[p.Name] = processSpec{
+			name:        p.Name,
+			main:        p.Main,
+			dependsOn:   p.DependsOn,
+			command:     p.Command,
+			logFileOpts: logFileOptions(cfg.CommandExec.LogFile, p),
+			opts:        opts,
+		}
+		names = append(names, p.Name)
+	}
+
+	if mainName == "" {
+		return nil, errors.New("no process is marked as main")
+	}
+
+	// topological sort, dependencies first, preserving
+	// declaration order otherwise
+	sorted := make([]processSpec, 0, len(names))
+	state := make(map[string]int, len(names)) // 1: visiting, 2: done
+
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		spec, ok := specs[name]
+		if !ok {
+			return fmt.Errorf("process %q depends on unknown process %q", from, name)
+		}
+
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle detected on process %q", name)
+		case 2:
+			return nil
+		}
+
+		state[name] = 1
+		for _, dep := range spec.dependsOn {
+			if err := visit(dep, name); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+
+		sorted = append(sorted, spec)
+
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+type supervisedProcess struct {
+	processSpec
+	exec *executor
+	// logFile is shared by every generation of the process
+	logFile *rotatingFile
+}
+
+// supervisor starts a set of processes in dependency order
+// and stops them in reverse order
+type supervisor struct {
+	procs []*supervisedProcess
+	main  *supervisedProcess
+	log   *slog.Logger
+	// terminal forwards delth terminal to the main process PTY,
+	// whatever its generation
+	terminal *terminalForwarder
+
+	// mu guards the executors of procs, replaced on reload
+	mu       sync.Mutex
+	reloadMu sync.Mutex
+}
+
+func NewSupervisor(ctx context.Context, specs []processSpec) *supervisor {
+	s := &supervisor{
+		log: slog.Default().With("component", "supervisor"),
+	}
+
+	for _, spec := range specs {
+		p := &supervisedProcess{
+			processSpec: spec,
+			exec:        NewCmdExecutor(ctx, spec.opts, spec.command[0], spec.command[1:]...),
+		}
+
+		if spec.main {
+			s.main = p
+			if spec.opts.TTY {
+				s.terminal = newTerminalForwarder(func() *ptySession {
+					return s.Main().runningPTY()
+				})
+			}
+		} else {
+			// sidecars ends are only logged, their
+			// restart policy is the one to rely on
+			name := spec.name
+			p.exec.SetOnCmdEndCb(func(err error) {
+				s.log.Warn("process has ended and will not be restarted", "process", name, "error", err)
+			})
+		}
+
+		s.procs = append(s.procs, p)
+	}
+
+	return s
+}
+
+func (s *supervisor) executor(p *supervisedProcess) *executor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return p.exec
+}
+
+// Main returns the executor of the main process
+func (s *supervisor) Main() *executor {
+	return s.executor(s.main)
+}
+
+// Process returns the executor of the process called name,
+// or the one of the main process if name is empty
+func (s *supervisor) Process(name string) (*executor, error) {
+	if name == "" {
+		return s.Main(), nil
+	}
+
+	for _, p := range s.procs {
+		if p.name == name {
+			return s.executor(p), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown process %q", name)
+}
+
+// ReopenLogFiles reopens the log files of every process
+func (s *supervisor) ReopenLogFiles() {
+	for _, p := range s.procs {
+		if p.logFile == nil {
+			continue
+		}
+
+		if err := p.logFile.Reopen(); err != nil {
+			s.log.Error("reopening log file", "process", p.name, "error", err)
+		}
+	}
+}
+
+// Start starts every process in dependency order. If any of them
+// fails to start, the already started ones are stopped.
+func (s *supervisor) Start() error {
+	if s.terminal != nil {
+		s.terminal.Start()
+	}
+
+	for i, p := range s.procs {
+		s.log.Debug("starting process", "process", p.name, "main", p.main)
+
+		if err := s.start(p); err != nil {
+			s.stop(s.procs[:i])
+			s.restoreTerminal()
+			return fmt.Errorf("starting process %q: %w", p.name, err)
+		}
+	}
+
+	if s.terminal != nil {
+		go s.restoreTerminalOnMainEnd()
+	}
+
+	return nil
+}
+
+// restoreTerminalOnMainEnd restores delth terminal once the main
+// process has ended for good, not replaced by a new generation
+func (s *supervisor) restoreTerminalOnMainEnd() {
+	for {
+		e := s.Main()
+		<-e.Done()
+
+		if s.Main() == e {
+			s.restoreTerminal()
+			return
+		}
+	}
+}
+
+func (s *supervisor) restoreTerminal() {
+	if s.terminal != nil {
+		s.terminal.Restore()
+	}
+}
+
+func (s *supervisor) start(p *supervisedProcess) error {
+	e := s.executor(p)
+
+	if p.logFileOpts != nil {
+		f, err := openRotatingFile(*p.logFileOpts)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		p.logFile = f
+		e.opts.LogFile = f
+	}
+
+	if err := e.Start(); err != nil {
+		if p.logFile != nil {
+			p.logFile.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Reload replaces the main process by a new generation of it, run
+// with the additional variables of env. The new generation is started
+// alongside the current one, which is only stopped once ready reports
+// that the new one can take over.
+func (s *supervisor) Reload(ctx context.Context, env []string, ready func(context.Context, *executor) error) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	current := s.Main()
+	next := current.newGeneration(env)
+
+	s.log.Info("starting new main process generation")
+
+	if err := next.Start(); err != nil {
+		return fmt.Errorf("starting new generation: %w", err)
+	}
+
+	if err := ready(ctx, next); err != nil {
+		if stopErr := next.Stop(); stopErr != nil {
+			s.log.Debug("stopping new main process generation", "error", stopErr)
+		}
+		return fmt.Errorf("waiting for new generation: %w", err)
+	}
+
+	next.adoptCallbacks(current)
+
+	s.mu.Lock()
+	s.main.exec = next
+	s.mu.Unlock()
+
+	if cb := next.callbacks().onCmdStart; cb != nil {
+		cb()
+	}
+
+	s.log.Info("new main process generation is ready, stopping the previous one")
+
+	if err := current.Stop(); err != nil {
+		s.log.Warn("stopping previous main process generation", "error", err)
+	}
+
+	return nil
+}
+
+// Kill immediately kills every process
+func (s *supervisor) Kill() {
+	for _, p := range s.procs {
+		if err := s.executor(p).Kill(); err != nil {
+			s.log.Error("killing process", "process", p.name, "error", err)
+		}
+	}
+}
+
+// Stop stops every process in reverse dependency order
+// and returns the main process Stop() error
+func (s *supervisor) Stop() error {
+	// let any reload in progress complete
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	// the terminal must be restored before Stop() returns,
+	// delth may exit right after
+	defer s.restoreTerminal()
+
+	return s.stop(s.procs)
+}
+
+func (s *supervisor) stop(procs []*supervisedProcess) error {
+	var mainErr error
+
+	for i := len(procs) - 1; i >= 0; i-- {
+		p := procs[i]
+
+		s.log.Debug("stopping process", "process", p.name, "main", p.main)
+
+		err := s.executor(p).Stop()
+		if p.main {
+			mainErr = err
+		} else if err != nil {
+			s.log.Debug("stopping process", "process", p.name, "error", err)
+		}
+
+		if p.logFile != nil {
+			p.logFile.Close()
+		}
+	}
+
+	return mainErr
+}
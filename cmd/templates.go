@@ -0,0 +1,229 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+type templateConfig struct {
+	Source        string        `mapstructure:"source" validate:"required"`
+	Destination   string        `mapstructure:"destination" validate:"required"`
+	Watch         bool          `mapstructure:"watch"`
+	WatchInterval time.Duration `mapstructure:"watch_interval"`
+	ReloadSignal  string        `mapstructure:"reload_signal"`
+	// Process is the name of the process to signal on changes,
+	// defaults to the main process
+	Process string `mapstructure:"process"`
+}
+
+const defaultTemplateWatchInterval = 5 * time.Second
+
+// configTemplate renders a Go text/template to a destination file.
+// Templates have access to the environment of the commands through
+// .Env and the 'env' function, and to files through the 'file' function.
+type configTemplate struct {
+	cfg          templateConfig
+	reloadSignal syscall.Signal
+	env          map[string]string
+	rendered     []byte
+	log          *slog.Logger
+}
+
+func newConfigTemplates(cfgs []templateConfig, env []string, procs []processSpec) ([]*configTemplate, error) {
+	envMap := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		envMap[k] = v
+	}
+
+	tmpls := make([]*configTemplate, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		t := &configTemplate{
+			cfg: cfg,
+			env: envMap,
+			log: slog.Default().With("component", "templates", "template", cfg.Source),
+		}
+
+		if cfg.Process != "" && !slices.ContainsFunc(procs, func(p processSpec) bool { return p.name == cfg.Process }) {
+			return nil, fmt.Errorf("template %q: unknown process %q", cfg.Source, cfg.Process)
+		}
+
+		if cfg.Watch {
+			sigName := cfg.ReloadSignal
+			if sigName == "" {
+				sigName = "SIGHUP"
+			}
+
+			sig, err := parseSignal(sigName)
+			if err != nil {
+				return nil, fmt.Errorf("template %q: parsing reload signal: %w", cfg.Source, err)
+			}
+			t.reloadSignal = sig
+
+			if t.cfg.WatchInterval <= 0 {
+				t.cfg.WatchInterval = defaultTemplateWatchInterval
+			}
+		}
+
+		tmpls = append(tmpls, t)
+	}
+
+	return tmpls, nil
+}
+
+func (t *configTemplate) funcs() template.FuncMap {
+	return template.FuncMap{
+		"env": func(key string) string {
+			return t.env[key]
+		},
+		"file": func(path string) (string, error) {
+			content, err := os.ReadFile(path)
+			return string(content), err
+		},
+		"hostname": os.Hostname,
+		"trim":     strings.TrimSpace,
+	}
+}
+
+func (t *configTemplate) execute() ([]byte, error) {
+	src, err := os.ReadFile(t.cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(filepath.Base(t.cfg.Source)).
+		Option("missingkey=error").
+		Funcs(t.funcs()).
+		Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, map[string]any{"Env": t.env}); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Render renders the template and writes the destination file if
+// its content has changed. It returns true if the file was written.
+func (t *configTemplate) Render() (bool, error) {
+	out, err := t.execute()
+	if err != nil {
+		return false, fmt.Errorf("rendering template %q: %w", t.cfg.Source, err)
+	}
+
+	if t.rendered != nil && bytes.Equal(out, t.rendered) {
+		return false, nil
+	}
+
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(t.cfg.Source); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	// write to a temporary file first so that the command
+	// never reads a partially written file
+	tmp, err := os.CreateTemp(filepath.Dir(t.cfg.Destination), "."+filepath.Base(t.cfg.Destination)+".*")
+	if err != nil {
+		return false, fmt.Errorf("writing template %q: %w", t.cfg.Source, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("writing template %q: %w", t.cfg.Source, err)
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("writing template %q: %w", t.cfg.Source, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("writing template %q: %w", t.cfg.Source, err)
+	}
+
+	if err := os.Rename(tmp.Name(), t.cfg.Destination); err != nil {
+		return false, fmt.Errorf("writing template %q: %w", t.cfg.Source, err)
+	}
+
+	t.rendered = out
+
+	t.log.Info("template rendered", "destination", t.cfg.Destination)
+
+	return true, nil
+}
+
+// Watch periodically re-renders the template until ctx is done and
+// calls reload with the configured signal whenever the output changes
+func (t *configTemplate) Watch(ctx context.Context, reload func(process string, sig syscall.Signal) error) {
+	ticker := time.NewTicker(t.cfg.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := t.Render()
+		if err != nil {
+			t.log.Error("re-rendering template", "error", err)
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		t.log.Info("template has changed, signaling process", "process", t.cfg.Process, "signal", t.reloadSignal.String())
+
+		if err := reload(t.cfg.Process, t.reloadSignal); err != nil {
+			t.log.Error("signaling process", "process", t.cfg.Process, "error", err)
+		}
+	}
+}
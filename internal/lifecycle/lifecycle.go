@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+
+// Package lifecycle tracks the lifecycle of delth: the state it is in
+// and the transitions between those states.
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is a lifecycle state of delth
+type State int32
+
+const (
+	// Starting is the initial state, while the processes are started
+	Starting State = iota
+	// Ready means the processes are started and serving
+	Ready
+	// Draining means delth reports itself unhealthy so that
+	// traffic is moved away before the processes are stopped
+	Draining
+	// Stopping means the processes are being stopped
+	Stopping
+	// Stopped is the final state, every process is stopped
+	Stopped
+	// Failed means the main process has failed and delth is terminating
+	Failed
+)
+
+var stateNames = map[State]string{
+	Starting: "starting",
+	Ready:    "ready",
+	Draining: "draining",
+	Stopping: "stopping",
+	Stopped:  "stopped",
+	Failed:   "failed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", int32(s))
+}
+
+// ShuttingDown reports whether s is a state in which delth
+// must no longer receive traffic
+func (s State) ShuttingDown() bool {
+	switch s {
+	case Draining, Stopping, Stopped, Failed:
+		return true
+	}
+
+	return false
+}
+
+// transitions lists the states reachable from every state. A shutdown
+// timeline may stop the processes without draining them first.
+var transitions = map[State][]State{
+	Starting: {Ready, Draining, Stopping, Failed},
+	Ready:    {Draining, Stopping, Failed},
+	Draining: {Stopping, Failed},
+	Stopping: {Stopped, Failed},
+	Failed:   {Stopping},
+	Stopped:  {},
+}
+
+// ErrInvalidTransition is returned when a transition is not
+// allowed from the current state
+var ErrInvalidTransition = errors.New("invalid lifecycle transition")
+
+// Transition describes a change of state
+type Transition struct {
+	From   State
+	To     State
+	Reason string
+	At     time.Time
+}
+
+// Subscriber is notified of every transition. It must not
+// trigger a transition itself.
+type Subscriber func(Transition)
+
+// Machine is the lifecycle state machine, it is safe for concurrent use
+type Machine struct {
+	mu          sync.Mutex
+	state       State
+	subscribers []Subscriber
+
+	// notifyMu serializes transitions so that subscribers
+	// are notified in order
+	notifyMu sync.Mutex
+}
+
+// New returns a state machine in the Starting state
+func New() *Machine {
+	return &Machine{
+		state: Starting,
+	}
+}
+
+// State returns the current state
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.state
+}
+
+// Subscribe registers s to be notified of every later transition
+func (m *Machine) Subscribe(s Subscriber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscribers = append(m.subscribers, s)
+}
+
+// Transition moves to state to, for the given reason, and notifies
+// subscribers. It returns ErrInvalidTransition if to is not reachable
+// from the current state.
+func (m *Machine) Transition(to State, reason string) error {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	from := m.state
+
+	allowed := false
+	for _, s := range transitions[from] {
+		if s == to {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		m.mu.Unlock()
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	m.state = to
+	subscribers := append([]Subscriber{}, m.subscribers...)
+	m.mu.Unlock()
+
+	t := Transition{
+		From:   from,
+		To:     to,
+		Reason: reason,
+		At:     time.Now(),
+	}
+
+	for _, s := range subscribers {
+		s(t)
+	}
+
+	return nil
+}
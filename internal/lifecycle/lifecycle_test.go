@@ -0,0 +1,173 @@
+/*
+Copyright © 2024 Rémi Ferrand
+
+Contributor(s): Rémi Ferrand <riton.github_at_gmail.com>, 2024
+
+This software is governed by the CeCILL license under French law and
+abiding by the rules of distribution of free software.  You can  use,
+modify and/ or redistribute the software under the terms of the CeCILL
+license as circulated by CEA, CNRS and INRIA at the following URL
+"http://www.cecill.info".
+
+As a counterpart to the access to the source code and  rights to copy,
+modify and redistribute granted by the license, users are provided only
+with a limited warranty  and the software's author,  the holder of the
+economic rights,  and the successive licensors  have only  limited
+liability.
+
+In this respect, the user's attention is drawn to the risks associated
+with loading,  using,  modifying and/or developing or reproducing the
+software by the user in light of its specific status of free software,
+that may mean  that it is complicated to manipulate,  and  that  also
+therefore means  that it is reserved for developers  and  experienced
+professionals having in-depth computer knowledge. Users are therefore
+encouraged to load and test the software's suitability as regards their
+requirements in conditions enabling the security of their systems and/or
+data to be ensured and,  more generally, to use and operate it in the
+same conditions as regards security.
+
+The fact that you are presently reading this means that you have had
+knowledge of the CeCILL license and that you accept its terms.
+*/
+package lifecycle
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+var allStates = []State{Starting, Ready, Draining, Stopping, Stopped, Failed}
+
+func TestTransitions(t *testing.T) {
+	allowed := map[State]map[State]bool{
+		Starting: {Ready: true, Draining: true, Stopping: true, Failed: true},
+		Ready:    {Draining: true, Stopping: true, Failed: true},
+		Draining: {Stopping: true, Failed: true},
+		Stopping: {Stopped: true, Failed: true},
+		Failed:   {Stopping: true},
+		Stopped:  {},
+	}
+
+	for _, from := range allStates {
+		for _, to := range allStates {
+			m := &Machine{state: from}
+
+			err := m.Transition(to, "test")
+
+			if allowed[from][to] {
+				if err != nil {
+					t.Errorf("transition from %s to %s: unexpected error %v", from, to, err)
+				}
+				if got := m.State(); got != to {
+					t.Errorf("transition from %s to %s: state is %s", from, to, got)
+				}
+				continue
+			}
+
+			if !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("transition from %s to %s: expected ErrInvalidTransition, got %v", from, to, err)
+			}
+			if got := m.State(); got != from {
+				t.Errorf("rejected transition from %s to %s: state is %s", from, to, got)
+			}
+		}
+	}
+}
+
+func TestNewIsStarting(t *testing.T) {
+	if got := New().State(); got != Starting {
+		t.Fatalf("expected a new machine to be %s, got %s", Starting, got)
+	}
+}
+
+func TestSubscribersSeeTransitionsInOrder(t *testing.T) {
+	m := New()
+
+	var first, second []Transition
+	m.Subscribe(func(t Transition) { first = append(first, t) })
+	m.Subscribe(func(t Transition) { second = append(second, t) })
+
+	path := []State{Ready, Draining, Stopping, Stopped}
+	for _, s := range path {
+		if err := m.Transition(s, "to "+s.String()); err != nil {
+			t.Fatalf("transition to %s: %v", s, err)
+		}
+	}
+
+	// rejected transitions are not notified
+	if err := m.Transition(Ready, "too late"); err == nil {
+		t.Fatal("expected the transition from stopped to ready to be rejected")
+	}
+
+	for name, got := range map[string][]Transition{"first": first, "second": second} {
+		if len(got) != len(path) {
+			t.Fatalf("%s subscriber: expected %d transitions, got %d", name, len(path), len(got))
+		}
+
+		from := Starting
+		for i, tr := range got {
+			if tr.From != from || tr.To != path[i] || tr.Reason != "to "+path[i].String() {
+				t.Errorf("%s subscriber: transition #%d is %s -> %s (%q)", name, i, tr.From, tr.To, tr.Reason)
+			}
+			if i > 0 && tr.At.Before(got[i-1].At) {
+				t.Errorf("%s subscriber: transition #%d happened before the previous one", name, i)
+			}
+			from = tr.To
+		}
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	m := New()
+
+	var mu sync.Mutex
+	var seen []Transition
+	m.Subscribe(func(t Transition) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, t)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			for _, s := range []State{Ready, Draining, Stopping, Stopped} {
+				if err := m.Transition(s, "concurrent"); err != nil && !errors.Is(err, ErrInvalidTransition) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = m.State().ShuttingDown()
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			m.Subscribe(func(Transition) {})
+		}()
+	}
+
+	wg.Wait()
+
+	// concurrent transitions are serialized: every transition
+	// starts from the state the previous one has reached
+	from := Starting
+	for i, tr := range seen {
+		if tr.From != from {
+			t.Fatalf("transition #%d starts from %s, expected %s", i, tr.From, from)
+		}
+		from = tr.To
+	}
+
+	if got := m.State(); got != Stopped || from != Stopped {
+		t.Fatalf("final state is %s, last notified state is %s, expected %s", got, from, Stopped)
+	}
+}